@@ -0,0 +1,218 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: backup.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Backups of the previous version of a file, made
+//   whenever a buffer is saved.
+//
+// A backup policy says how backups are named and how many are kept.
+// A single backup is "file.bak", and is replaced by every save.
+// Numbered backups are "file.~1~", "file.~2~" and so on, with the
+// oldest removed once there are more than the policy keeps. A backup
+// directory holds numbered backups for files anywhere, named by the
+// file's full path with each separator replaced by "!" (and each "!"
+// doubled), so that "/src/apex/buf.go" is backed up as
+// "!src!apex!buf.go.~1~".
+//
+// The backup is a hard link to the old file where possible, so that
+// saving doesn't have to copy it. Saves replace the file rather than
+// rewriting it, so the link keeps the old contents.
+
+package buf
+
+import (
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+type BackupMode int
+
+const (
+  BACKUP_NONE BackupMode = iota
+  BACKUP_SINGLE
+  BACKUP_NUMBERED
+  BACKUP_DIRECTORY
+)
+
+// How backups are made. Keep is the number of numbered backups to
+// keep, with 0 meaning all of them; Dir is the backup directory for
+// BACKUP_DIRECTORY, which is created when it's first needed.
+type BackupPolicy struct {
+  Mode BackupMode
+  Keep int
+  Dir  string
+}
+
+// A backup of a file. Number is 0 for a single backup.
+type Backup struct {
+  Path    string
+  Number  int
+  ModTime time.Time
+}
+
+// The policy for new buffers, which keeps a single backup.
+var DefaultBackupPolicy = BackupPolicy{Mode: BACKUP_SINGLE}
+
+func (self *GapBuffer) SetBackupPolicy(policy BackupPolicy) { self.backup = policy }
+
+func (self *GapBuffer) GetBackupPolicy() BackupPolicy { return self.backup }
+
+// List the backups of the buffer's file, oldest first.
+func (self *GapBuffer) ListBackups() ([]Backup, error) {
+  backups, err := self.backup.list(saveTarget(self.filename))
+  if err != nil {
+    return nil, ioError(err)
+  }
+  return backups, nil
+}
+
+// Replace the contents of the buffer with a backup. The backup is
+// decoded just like the file itself, and its encoding and line ending
+// style become the buffer's. The buffer is dirty afterwards, and the
+// restore can be undone as a single step.
+func (self *GapBuffer) RestoreBackup(backup Backup) error {
+  contents, err := os.ReadFile(backup.Path)
+  if err != nil {
+    return ioError(err)
+  }
+  contents, err = self.decodeFile(contents)
+  if err != nil {
+    return err
+  }
+  pos := self.GetCurrentPosition()
+  self.ClearCursors()
+  self.BeginUndoGroup()
+  self.MoveCursorTo(0)
+  self.cut(self.Length())
+  self.insertChars(contents)
+  self.EndUndoGroup()
+  if pos > self.Length() {
+    pos = self.Length()
+  }
+  self.MoveCursorTo(pos)
+  return nil
+}
+
+// Back up a file that's about to be replaced.
+func (self BackupPolicy) backup(filename string) error {
+  if self.Mode == BACKUP_NONE || !fileExists(filename) {
+    return nil
+  }
+  if self.Mode == BACKUP_SINGLE {
+    backup := filename + ".bak"
+    os.Remove(backup)
+    return linkOrCopy(filename, backup)
+  }
+  prefix, err := self.prefix(filename)
+  if err != nil {
+    return err
+  }
+  if self.Mode == BACKUP_DIRECTORY {
+    if err := os.MkdirAll(self.Dir, 0700); err != nil {
+      return err
+    }
+  }
+  backups, err := self.list(filename)
+  if err != nil {
+    return err
+  }
+  next := 1
+  if len(backups) > 0 {
+    next = backups[len(backups)-1].Number + 1
+  }
+  if err := linkOrCopy(filename, prefix+".~"+strconv.Itoa(next)+"~"); err != nil {
+    return err
+  }
+  if self.Keep > 0 {
+    // The new backup isn't in the list, so keep one fewer of the old ones.
+    for len(backups) >= self.Keep {
+      os.Remove(backups[0].Path)
+      backups = backups[1:]
+    }
+  }
+  return nil
+}
+
+// Get the name that numbered backups of a file start with.
+func (self BackupPolicy) prefix(filename string) (string, error) {
+  if self.Mode != BACKUP_DIRECTORY {
+    return filename, nil
+  }
+  abs, err := filepath.Abs(filename)
+  if err != nil {
+    return "", err
+  }
+  mangled := strings.ReplaceAll(filepath.ToSlash(abs), "!", "!!")
+  mangled = strings.ReplaceAll(mangled, "/", "!")
+  return filepath.Join(self.Dir, mangled), nil
+}
+
+// List the backups of a file, oldest first.
+func (self BackupPolicy) list(filename string) ([]Backup, error) {
+  if self.Mode == BACKUP_NONE {
+    return nil, nil
+  }
+  if self.Mode == BACKUP_SINGLE {
+    info, err := os.Stat(filename + ".bak")
+    if err != nil {
+      return nil, nil
+    }
+    return []Backup{{filename + ".bak", 0, info.ModTime()}}, nil
+  }
+  prefix, err := self.prefix(filename)
+  if err != nil {
+    return nil, err
+  }
+  dir, base := filepath.Split(prefix)
+  if dir == "" {
+    dir = "."
+  }
+  entries, err := os.ReadDir(dir)
+  if os.IsNotExist(err) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+  var result []Backup
+  for _, entry := range entries {
+    name := entry.Name()
+    if !strings.HasPrefix(name, base+".~") || !strings.HasSuffix(name, "~") {
+      continue
+    }
+    n, err := strconv.Atoi(name[len(base)+2 : len(name)-1])
+    if err != nil || n < 1 {
+      continue
+    }
+    info, err := entry.Info()
+    if err != nil {
+      continue
+    }
+    result = append(result, Backup{filepath.Join(dir, name), n, info.ModTime()})
+  }
+  sort.Slice(result, func(i, j int) bool { return result[i].Number < result[j].Number })
+  return result, nil
+}
+
+// Copy a file, or link it if the file system can.
+func linkOrCopy(from string, to string) error {
+  if os.Link(from, to) != nil {
+    return copyFile(from, to)
+  }
+  return nil
+}
@@ -19,12 +19,50 @@
 package buf
 
 import (
+  "bufio"
+  "bytes"
+  "errors"
   "fmt"
+  "io"
+  "io/fs"
+  "io/ioutil"
+  "math/rand"
+  "os"
+  "path/filepath"
+  "regexp"
+  "runtime"
+  "strings"
   "testing"
+  "testing/iotest"
+  "text/scanner"
+  "time"
 )
 
-func ExpectBufferValue(t *testing.T, b *GapBuffer, before string, after string) {
-  pre, post := b.StringPair()
+// The implementations of EditBuffer that the shared tests are run
+// against.
+var bufferImplementations = []struct {
+  name   string
+  create func(size int) EditBuffer
+}{
+  {"GapBuffer", func(size int) EditBuffer { return NewBuffer(size) }},
+  {"PieceTable", func(size int) EditBuffer { return NewPieceTable(size) }},
+  {"Rope", func(size int) EditBuffer { return NewRope() }},
+  {"SyncBuffer", func(size int) EditBuffer { return NewSyncBuffer(NewBuffer(size)) }},
+}
+
+func forEachBuffer(t *testing.T, test func(t *testing.T, b EditBuffer)) {
+  for _, impl := range bufferImplementations {
+    t.Run(impl.name, func(t *testing.T) { test(t, impl.create(100)) })
+  }
+}
+
+// Every buffer implementation provides StringPair for debugging.
+type debugBuffer interface {
+  StringPair() (before string, after string)
+}
+
+func ExpectBufferValue(t *testing.T, b EditBuffer, before string, after string) {
+  pre, post := b.(debugBuffer).StringPair()
   if pre != before {
     t.Error(fmt.Sprintf("Buffer value '%v' before gap did not match expected '%v'",
       pre, before))
@@ -43,17 +81,19 @@ func ExpectStringEquals(t *testing.T, name string, expected string, actual strin
 }
 
 func TestSingleInsert(t *testing.T) {
-  b := NewBuffer(10)
-  b.InsertChars([]uint8{'a', 'b', 'c', 'd'})
-  ExpectBufferValue(t, b, "abcd", "")
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertChars([]uint8{'a', 'b', 'c', 'd'})
+    ExpectBufferValue(t, b, "abcd", "")
+  })
 }
 
 func TestInserts(t *testing.T) {
-  b := NewBuffer(100)
-  b.InsertChars([]uint8{'a', 'b', 'c', 'd'})
-  b.InsertChar('q')
-  b.InsertChar('r')
-  ExpectBufferValue(t, b, "abcdqr", "")
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertChars([]uint8{'a', 'b', 'c', 'd'})
+    b.InsertChar('q')
+    b.InsertChar('r')
+    ExpectBufferValue(t, b, "abcdqr", "")
+  })
 }
 
 func TestExpand(t *testing.T) {
@@ -67,7 +107,7 @@ func TestExpand(t *testing.T) {
       "abcdefghijklmnopqrstuvwxyz\nabcdefghijklmnopqrstuvwxyz\n",
     "")
 
-  if cap(b.prechars) <= 100 {
+  if len(b.data) <= 100 {
     t.Error("Expected buffer to expand")
   }
   b.MoveCursorTo(50)
@@ -97,156 +137,345 @@ func TestExpand(t *testing.T) {
 }
 
 func TestInsertAndMove(t *testing.T) {
-  b := NewBuffer(100)
-  b.InsertChars([]uint8{'a', 'b', 'c', 'd', 'e'})
-  b.StepCursorBackward()
-  b.StepCursorBackward()
-  b.StepCursorBackward()
-  ExpectBufferValue(t, b, "ab", "cde")
-  b.InsertChars([]uint8{'1', '2', '3'})
-  b.StepCursorForward()
-  b.StepCursorForward()
-  ExpectBufferValue(t, b, "ab123cd", "e")
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertChars([]uint8{'a', 'b', 'c', 'd', 'e'})
+    b.StepCursorBackward()
+    b.StepCursorBackward()
+    b.StepCursorBackward()
+    ExpectBufferValue(t, b, "ab", "cde")
+    b.InsertChars([]uint8{'1', '2', '3'})
+    b.StepCursorForward()
+    b.StepCursorForward()
+    ExpectBufferValue(t, b, "ab123cd", "e")
+  })
 }
 
 func TestColumnTracking(t *testing.T) {
-  b := NewBuffer(100)
-  b.InsertChars([]uint8{'a', 'b', 'c', 'd', 'e', 'f', '\n',
-    'g', 'h', 'i', 'j', 'k', 'l', '\n',
-    'm', 'n', 'o', 'p', 'q', 'r', '\n',
-    's', 't', 'u',
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertChars([]uint8{'a', 'b', 'c', 'd', 'e', 'f', '\n',
+      'g', 'h', 'i', 'j', 'k', 'l', '\n',
+      'm', 'n', 'o', 'p', 'q', 'r', '\n',
+      's', 't', 'u',
+    })
+    b.MoveCursorTo(12)
+    if b.GetCurrentColumn() != 5 {
+      t.Error(fmt.Sprintf("Expected column 5, but found %v", b.GetCurrentColumn()))
+    }
   })
-  b.MoveCursorTo(12)
-  if b.GetCurrentColumn() != 5 {
-    t.Error(fmt.Sprintf("Expected column 5, but found %v", b.GetCurrentColumn()))
-  }
 }
 
 func TestGotoPosition(t *testing.T) {
-  b := NewBuffer(100)
-  b.InsertChars([]uint8{'a', 'b', 'c', 'd', 'e', 'f', 'g', '\n',
-    'h', 'i', 'j',
-    'k', 'l', 'm', 'n', 'o', 'p',
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertChars([]uint8{'a', 'b', 'c', 'd', 'e', 'f', 'g', '\n',
+      'h', 'i', 'j',
+      'k', 'l', 'm', 'n', 'o', 'p',
+    })
+    b.MoveCursorTo(4)
+    ExpectBufferValue(t, b, "abcd", "efg\nhijklmnop")
+    if b.GetCurrentColumn() != 4 {
+      t.Error(fmt.Sprintf("Expected buffer to be in column 4, but found column %v",
+        b.GetCurrentColumn()))
+    }
+    b.MoveCursorTo(8)
+    ExpectBufferValue(t, b, "abcdefg\n", "hijklmnop")
+    if b.GetCurrentColumn() != 0 {
+      t.Error(fmt.Sprintf("Expected buffer to be in column 0, but found column %v",
+        b.GetCurrentColumn()))
+    }
   })
-  b.MoveCursorTo(4)
-  ExpectBufferValue(t, b, "abcd", "efg\nhijklmnop")
-  if b.GetCurrentColumn() != 3 {
-    t.Error(fmt.Sprintf("Expected buffer to be in column 3, but found column %v",
-      b.GetCurrentColumn()))
-  }
-  b.MoveCursorTo(8)
-  ExpectBufferValue(t, b, "abcdefg\n", "hijklmnop")
-  if b.GetCurrentColumn() != 0 {
-    t.Error(fmt.Sprintf("Expected buffer to be in column 0, but found column %v",
-      b.GetCurrentColumn()))
-  }
 }
 
 func TestCut(t *testing.T) {
-  b := NewBuffer(100)
-  b.InsertString("abcde\nfghijklm")
-  b.MoveCursorTo(4)
-  cutbuf := b.Cut(5)
-  if len(cutbuf) != 5 {
-    t.Error(fmt.Sprintf("Expected cutbuf length = 5, but found %v", len(cutbuf)))
-  }
-  ExpectStringEquals(t, "cut buffer", "e\nfgh", string(cutbuf))
-  ExpectBufferValue(t, b, "abcd", "ijklm")
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("abcde\nfghijklm")
+    b.MoveCursorTo(4)
+    cutbuf := b.Cut(5)
+    if len(cutbuf) != 5 {
+      t.Error(fmt.Sprintf("Expected cutbuf length = 5, but found %v", len(cutbuf)))
+    }
+    ExpectStringEquals(t, "cut buffer", "e\nfgh", string(cutbuf))
+    ExpectBufferValue(t, b, "abcd", "ijklm")
+  })
 }
 
 func TestCutBackwards(t *testing.T) {
-  b := NewBuffer(100)
-  b.InsertString("abcde\nfghijklm")
-  b.MoveCursorTo(9)
-  cutbuf := b.Cut(-5)
-  if len(cutbuf) != 5 {
-    t.Error(fmt.Sprintf("Expected cutbuf length = 5, but found %v", len(cutbuf)))
-  }
-  ExpectStringEquals(t, "cut buffer", "e\nfgh", string(cutbuf))
-  ExpectBufferValue(t, b, "abcd", "ijklm")
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("abcde\nfghijklm")
+    b.MoveCursorTo(9)
+    cutbuf := b.Cut(-5)
+    if len(cutbuf) != 5 {
+      t.Error(fmt.Sprintf("Expected cutbuf length = 5, but found %v", len(cutbuf)))
+    }
+    ExpectStringEquals(t, "cut buffer", "e\nfgh", string(cutbuf))
+    ExpectBufferValue(t, b, "abcd", "ijklm")
+  })
 }
 
 func TestCutPastEnd(t *testing.T) {
-  b := NewBuffer(100)
-  b.InsertString("abcdefg\nhijklmnop\nqrstuvwxyz\n")
-  b.MoveCursorTo(20)
-  cutbuf := b.Cut(20)
-  if len(cutbuf) != 9 {
-    t.Error(fmt.Sprintf("Expected cutbuf length = 9, but found %v", len(cutbuf)))
-  }
-  ExpectStringEquals(t, "cut buffer", "stuvwxyz\n", string(cutbuf))
-  ExpectBufferValue(t, b, "abcdefg\nhijklmnop\nqr", "")
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("abcdefg\nhijklmnop\nqrstuvwxyz\n")
+    b.MoveCursorTo(20)
+    cutbuf := b.Cut(20)
+    if len(cutbuf) != 9 {
+      t.Error(fmt.Sprintf("Expected cutbuf length = 9, but found %v", len(cutbuf)))
+    }
+    ExpectStringEquals(t, "cut buffer", "stuvwxyz\n", string(cutbuf))
+    ExpectBufferValue(t, b, "abcdefg\nhijklmnop\nqr", "")
+  })
 }
 
 func TestCutPastStart(t *testing.T) {
-  b := NewBuffer(100)
-  b.InsertString("abcdefg\nhijklmnop\nqrstuvwxyz\n")
-  b.MoveCursorTo(20)
-  cutbuf := b.Cut(-30)
-  if len(cutbuf) != 20 {
-    t.Error(fmt.Sprintf("Expected cutbuf length = 20, but found %v", len(cutbuf)))
-  }
-  ExpectStringEquals(t, "cut buffer", "abcdefg\nhijklmnop\nqr", string(cutbuf))
-  ExpectBufferValue(t, b, "", "stuvwxyz\n")
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("abcdefg\nhijklmnop\nqrstuvwxyz\n")
+    b.MoveCursorTo(20)
+    cutbuf := b.Cut(-30)
+    if len(cutbuf) != 20 {
+      t.Error(fmt.Sprintf("Expected cutbuf length = 20, but found %v", len(cutbuf)))
+    }
+    ExpectStringEquals(t, "cut buffer", "abcdefg\nhijklmnop\nqr", string(cutbuf))
+    ExpectBufferValue(t, b, "", "stuvwxyz\n")
+  })
 }
 
 func TestCopy(t *testing.T) {
-  b := NewBuffer(100)
-  b.InsertString("abcde\nfghijklm")
-  b.MoveCursorTo(4)
-  copybuf := b.Copy(5)
-  if len(copybuf) != 5 {
-    t.Error(fmt.Sprintf("Expected copybuf length = 5, but found %v", len(copybuf)))
-  }
-  ExpectStringEquals(t, "copy buffer", "e\nfgh", string(copybuf))
-  ExpectBufferValue(t, b, "abcd", "e\nfghijklm")
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("abcde\nfghijklm")
+    b.MoveCursorTo(4)
+    copybuf := b.Copy(5)
+    if len(copybuf) != 5 {
+      t.Error(fmt.Sprintf("Expected copybuf length = 5, but found %v", len(copybuf)))
+    }
+    ExpectStringEquals(t, "copy buffer", "e\nfgh", string(copybuf))
+    ExpectBufferValue(t, b, "abcd", "e\nfghijklm")
+  })
 }
 
 func TestCopyBackwards(t *testing.T) {
-  b := NewBuffer(100)
-  b.InsertString("abcde\nfghijklm")
-  b.MoveCursorTo(9)
-  copybuf := b.Copy(-5)
-  if len(copybuf) != 5 {
-    t.Error(fmt.Sprintf("Expected copybuf length = 5, but found %v",
-      len(copybuf)))
-  }
-  ExpectStringEquals(t, "copy buffer", "e\nfgh", string(copybuf))
-  ExpectBufferValue(t, b, "abcde\nfgh", "ijklm")
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("abcde\nfghijklm")
+    b.MoveCursorTo(9)
+    copybuf := b.Copy(-5)
+    if len(copybuf) != 5 {
+      t.Error(fmt.Sprintf("Expected copybuf length = 5, but found %v",
+        len(copybuf)))
+    }
+    ExpectStringEquals(t, "copy buffer", "e\nfgh", string(copybuf))
+    ExpectBufferValue(t, b, "abcde\nfgh", "ijklm")
+  })
 }
 
 func TestCopyPastEnd(t *testing.T) {
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("abcdefg\nhijklmnop\nqrstuvwxyz\n")
+    b.MoveCursorTo(20)
+    copybuf := b.Copy(20)
+    if len(copybuf) != 9 {
+      t.Error(fmt.Sprintf("Expected copybuf length = 9, but found %v", len(copybuf)))
+    }
+    ExpectStringEquals(t, "copy buffer", "stuvwxyz\n", string(copybuf))
+    ExpectBufferValue(t, b, "abcdefg\nhijklmnop\nqr", "stuvwxyz\n")
+  })
+}
+
+func TestUndoInsert(t *testing.T) {
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("123456789\n123456789\n")
+    b.MoveCursorTo(6)
+    b.InsertString("abcd")
+    ExpectBufferValue(t, b, "123456abcd", "789\n123456789\n")
+    b.Undo()
+    ExpectBufferValue(t, b, "123456", "789\n123456789\n")
+  })
+}
+
+func TestUndoCut(t *testing.T) {
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("123456789\n123456789\n")
+    b.MoveCursorTo(6)
+    cutbuf := b.Cut(10)
+    ExpectStringEquals(t, "cut buffer", "789\n123456", string(cutbuf))
+    ExpectBufferValue(t, b, "123456", "789\n")
+    b.Undo()
+    ExpectBufferValue(t, b, "123456", "789\n123456789\n")
+  })
+}
+
+func TestRedoInsert(t *testing.T) {
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("123456789\n123456789\n")
+    b.MoveCursorTo(6)
+    b.InsertString("abcd")
+    b.Undo()
+    if !b.CanRedo() {
+      t.Error("Expected redo to be available after an undo")
+    }
+    b.Redo()
+    ExpectBufferValue(t, b, "123456abcd", "789\n123456789\n")
+    if b.CanRedo() {
+      t.Error("Expected redo stack to be empty after redoing")
+    }
+  })
+}
+
+func TestRedoCut(t *testing.T) {
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("123456789\n123456789\n")
+    b.MoveCursorTo(6)
+    b.Cut(10)
+    b.Undo()
+    b.Redo()
+    ExpectBufferValue(t, b, "123456", "789\n")
+    b.Undo()
+    ExpectBufferValue(t, b, "123456", "789\n123456789\n")
+  })
+}
+
+func TestEditClearsRedo(t *testing.T) {
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("abc")
+    b.InsertString("def")
+    b.Undo()
+    b.InsertString("xyz")
+    if b.CanRedo() {
+      t.Error("Expected a new edit to clear the redo history")
+    }
+    if b.Redo() == nil {
+      t.Error("Redo with an empty redo history should have failed")
+    }
+    ExpectBufferValue(t, b, "abcxyz", "")
+  })
+}
+
+func TestEmptyEditKeepsRedo(t *testing.T) {
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("abc")
+    b.InsertString("def")
+    b.Undo()
+    b.Cut(1)
+    b.InsertString("")
+    b.MoveCursorTo(0)
+    b.Cut(-1)
+    if !b.CanRedo() || !b.CanUndo() {
+      t.Error(fmt.Sprintf("Expected empty edits to leave undo and redo alone, got %v/%v",
+        b.CanUndo(), b.CanRedo()))
+    }
+    b.Redo()
+    text, _ := b.GetRange(0, b.Length())
+    ExpectStringEquals(t, "redone buffer", "abcdef", string(text))
+  })
+}
+
+func TestUndoEmpty(t *testing.T) {
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    if b.CanUndo() {
+      t.Error("Expected a new buffer to have nothing to undo")
+    }
+    if b.Undo() == nil {
+      t.Error("Undo with an empty undo history should have failed")
+    }
+  })
+}
+
+func TestUndoGroup(t *testing.T) {
   b := NewBuffer(100)
-  b.InsertString("abcdefg\nhijklmnop\nqrstuvwxyz\n")
-  b.MoveCursorTo(20)
-  copybuf := b.Copy(20)
-  if len(copybuf) != 9 {
-    t.Error(fmt.Sprintf("Expected copybuf length = 9, but found %v", len(copybuf)))
+  b.InsertString("123456789\n")
+  b.BeginUndoGroup()
+  b.MoveCursorTo(3)
+  b.Cut(3)
+  b.InsertString("abc")
+  b.InsertChar('d')
+  b.EndUndoGroup()
+  ExpectBufferValue(t, b, "123abcd", "789\n")
+  b.Undo()
+  ExpectStringEquals(t, "buffer", "123456789\n", b.String())
+  b.Redo()
+  ExpectStringEquals(t, "buffer", "123abcd789\n", b.String())
+  b.Undo()
+  b.Undo()
+  ExpectStringEquals(t, "buffer", "", b.String())
+}
+
+func TestNestedUndoGroups(t *testing.T) {
+  b := NewBuffer(100)
+  b.BeginUndoGroup()
+  b.InsertString("abc")
+  b.BeginUndoGroup()
+  b.InsertString("def")
+  b.InsertString("ghi")
+  b.EndUndoGroup()
+  if b.CanUndo() {
+    t.Error("Expected undo to be unavailable inside an open undo group")
+  }
+  b.InsertString("jkl")
+  b.EndUndoGroup()
+  b.Undo()
+  ExpectStringEquals(t, "buffer", "", b.String())
+  if b.CanUndo() {
+    t.Error("Expected nested groups to be undone as a single step")
+  }
+  if b.EndUndoGroup() == nil {
+    t.Error("Ending an undo group that was never started should have failed")
   }
-  ExpectStringEquals(t, "copy buffer", "stuvwxyz\n", string(copybuf))
-  ExpectBufferValue(t, b, "abcdefg\nhijklmnop\nqr", "stuvwxyz\n")
 }
 
-func TestUndoInsert(t *testing.T) {
+func TestAbortUndoGroup(t *testing.T) {
   b := NewBuffer(100)
-  b.InsertString("123456789\n123456789\n")
-  b.MoveCursorTo(6)
-  b.InsertString("abcd")
-  ExpectBufferValue(t, b, "123456abcd", "789\n123456789\n")
+  b.InsertString("123456789\n")
+  b.BeginUndoGroup()
+  b.InsertString("abc")
+  b.BeginUndoGroup()
+  b.MoveCursorTo(0)
+  b.Cut(4)
+  b.EndUndoGroup()
+  b.AbortUndoGroup()
+  ExpectStringEquals(t, "buffer", "123456789\n", b.String())
   b.Undo()
-  ExpectBufferValue(t, b, "123456", "789\n123456789\n")
+  ExpectStringEquals(t, "buffer", "", b.String())
 }
 
-func TestUndoCut(t *testing.T) {
+func TestUndoBranches(t *testing.T) {
   b := NewBuffer(100)
-  b.InsertString("123456789\n123456789\n")
-  b.MoveCursorTo(6)
-  cutbuf := b.Cut(10)
-  ExpectStringEquals(t, "cut buffer", "789\n123456", string(cutbuf))
-  ExpectBufferValue(t, b, "123456", "789\n")
+  b.InsertString("abc")
+  b.InsertString("def")
   b.Undo()
-  // TODO: fill in?????
-  //  b.InsertString("123456|789\n123456789\n")
+  b.InsertString("xyz")
+  branches := b.UndoBranches()
+  if len(branches) != 2 {
+    t.Fatal(fmt.Sprintf("Expected 2 undo branches, but found %v", len(branches)))
+  }
+  b.UndoTo(branches[0])
+  ExpectStringEquals(t, "buffer", "abcdef", b.String())
+  b.UndoTo(branches[1])
+  ExpectStringEquals(t, "buffer", "abcxyz", b.String())
+  b.UndoTo(b.UndoTreeRoot())
+  ExpectStringEquals(t, "buffer", "", b.String())
+  // Redo should follow the most recently visited branch.
+  b.Redo()
+  b.Redo()
+  ExpectStringEquals(t, "buffer", "abcxyz", b.String())
+}
+
+func TestUndoEarlierAndLater(t *testing.T) {
+  start := time.Date(2011, 1, 1, 12, 0, 0, 0, time.UTC)
+  now := start
+  clock = func() time.Time { return now }
+  defer func() { clock = time.Now }()
+
+  b := NewBuffer(100)
+  now = start.Add(10 * time.Second)
+  b.InsertString("abc")
+  now = start.Add(20 * time.Second)
+  b.InsertString("def")
+  now = start.Add(30 * time.Second)
+  b.InsertString("ghi")
+  b.UndoEarlier(15 * time.Second)
+  ExpectStringEquals(t, "buffer", "abc", b.String())
+  b.UndoLater(10 * time.Second)
+  ExpectStringEquals(t, "buffer", "abcdef", b.String())
+  b.UndoEarlier(time.Hour)
+  ExpectStringEquals(t, "buffer", "", b.String())
+  b.UndoLater(time.Hour)
+  ExpectStringEquals(t, "buffer", "abcdefghi", b.String())
 }
 
 //
@@ -254,7 +483,7 @@ func TestUndoCut(t *testing.T) {
 //
 func ExpectCharValue(t *testing.T, b EditBuffer, pos int, expected uint8) {
   c, success := b.GetCharAt(pos)
-  if success != SUCCEEDED {
+  if success != nil {
     t.Error(fmt.Sprintf("Retrieving char at position %v failed", pos))
   }
   if c != expected {
@@ -265,25 +494,26 @@ func ExpectCharValue(t *testing.T, b EditBuffer, pos int, expected uint8) {
 
 
 func TestGetCharAt(t *testing.T) {
-  b := NewBuffer(100)
-  b.InsertString("123456789\n123456789\n")
-  ExpectCharValue(t, b, 3, '4')
-  ExpectCharValue(t, b, 13, '4')
-  b.MoveCursorTo(2)
-  ExpectCharValue(t, b, 3, '4')
-  ExpectCharValue(t, b, 13, '4')
-  b.MoveCursorTo(12)
-  ExpectCharValue(t, b, 3, '4')
-  ExpectCharValue(t, b, 13, '4')
-  _, success := b.GetCharAt(100)
-  if success == SUCCEEDED {
-    t.Error("Retrieving a character beyond buffer end should have failed")
-  }
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("123456789\n123456789\n")
+    ExpectCharValue(t, b, 3, '4')
+    ExpectCharValue(t, b, 13, '4')
+    b.MoveCursorTo(2)
+    ExpectCharValue(t, b, 3, '4')
+    ExpectCharValue(t, b, 13, '4')
+    b.MoveCursorTo(12)
+    ExpectCharValue(t, b, 3, '4')
+    ExpectCharValue(t, b, 13, '4')
+    _, success := b.GetCharAt(100)
+    if success == nil {
+      t.Error("Retrieving a character beyond buffer end should have failed")
+    }
+  })
 }
 
 func ExpectLinePosition(t *testing.T, b EditBuffer, line int, expected int) {
   pos, success := b.GetPositionOfLine(line)
-  if success != SUCCEEDED {
+  if success != nil {
     t.Error(fmt.Sprintf("Line position of line '%v' failed", line))
   }
   if pos != expected {
@@ -293,21 +523,59 @@ func ExpectLinePosition(t *testing.T, b EditBuffer, line int, expected int) {
 }
 
 func TestGetPositionOfLine(t *testing.T) {
-  b := NewBuffer(100)
-  b.InsertString("123456789\n123456789\n")
-  b.InsertString("123456789\n123456789\n")
-  b.InsertString("123456789\n123456789\n")
-  b.InsertString("123456789\n123456789\n")
-  ExpectLinePosition(t, b, 1, 0)
-  ExpectLinePosition(t, b, 7, 60)
-  b.MoveCursorTo(12)
-  ExpectLinePosition(t, b, 1, 0)
-  ExpectLinePosition(t, b, 7, 60)
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("123456789\n123456789\n")
+    b.InsertString("123456789\n123456789\n")
+    b.InsertString("123456789\n123456789\n")
+    b.InsertString("123456789\n123456789\n")
+    ExpectLinePosition(t, b, 1, 0)
+    ExpectLinePosition(t, b, 7, 60)
+    b.MoveCursorTo(12)
+    ExpectLinePosition(t, b, 1, 0)
+    ExpectLinePosition(t, b, 7, 60)
+  })
+}
+
+func TestLineIndex(t *testing.T) {
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("one\ntwo\nthree\nfour\n")
+    if b.LineCount() != 5 {
+      t.Error(fmt.Sprintf("Expected 5 lines, but found %v", b.LineCount()))
+    }
+    b.MoveCursorTo(6)
+    b.InsertString("X\nY")
+    // one\ntwX\nYo\nthree\nfour\n
+    ExpectLinePosition(t, b, 3, 8)
+    ExpectLinePosition(t, b, 5, 17)
+    ExpectLineAndColumn(t, b, 13, 4, 2)
+    b.MoveCursorTo(2)
+    b.Cut(9)
+    // onthree\nfour\n
+    if b.LineCount() != 3 {
+      t.Error(fmt.Sprintf("Expected 3 lines, but found %v", b.LineCount()))
+    }
+    ExpectLinePosition(t, b, 2, 8)
+    ExpectLineAndColumn(t, b, 10, 2, 2)
+    b.MoveToLine(2)
+    if b.GetCurrentPosition() != 8 || b.GetCurrentLine() != 2 || b.GetCurrentColumn() != 0 {
+      t.Error(fmt.Sprintf("Expected cursor at 8 (2:0) but found %v (%v:%v)",
+        b.GetCurrentPosition(), b.GetCurrentLine(), b.GetCurrentColumn()))
+    }
+    b.MoveCursorTo(12)
+    b.MoveCursorTo(5)
+    if b.GetCurrentLine() != 1 || b.GetCurrentColumn() != 5 {
+      t.Error(fmt.Sprintf("Expected cursor at 1:5 but found %v:%v",
+        b.GetCurrentLine(), b.GetCurrentColumn()))
+    }
+    if _, err := b.GetPositionOfLine(3); err == nil {
+      t.Error("Expected the empty last line not to have a position")
+    }
+  })
 }
 
 func ExpectChars(t *testing.T, b EditBuffer, start int, end int, expected string) {
   bytes, success := b.GetRange(start, end)
-  if success != SUCCEEDED {
+  if success != nil {
     t.Error(fmt.Sprintf("Get Chars %v-%v failed", start, end))
   }
   if string(bytes) != expected {
@@ -317,18 +585,22 @@ func ExpectChars(t *testing.T, b EditBuffer, start int, end int, expected string
 }
 
 func TestGetChars(t *testing.T) {
-  b := NewBuffer(100)
-  b.InsertString("aaaaabbbb\ncccccdddd\neeeeeffff\nggggghhhh\niiiiijjjj\n")
-  ExpectChars(t, b, 10, 20, "cccccdddd\n")
-  ExpectChars(t, b, 27, 32, "ff\ngg")
-  b.MoveCursorTo(31)
-  ExpectChars(t, b, 27, 32, "ff\ngg")
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("aaaaabbbb\ncccccdddd\neeeeeffff\nggggghhhh\niiiiijjjj\n")
+    ExpectChars(t, b, 10, 20, "cccccdddd\n")
+    ExpectChars(t, b, 27, 32, "ff\ngg")
+    b.MoveCursorTo(31)
+    ExpectChars(t, b, 27, 32, "ff\ngg")
+    if _, err := b.GetRange(4, 2); !errors.Is(err, INVALID_RANGE.Err()) {
+      t.Error(fmt.Sprintf("Expected a backwards range to be INVALID_RANGE, got %v", err))
+    }
+  })
 }
 
 
 func ExpectLineAndColumn(t *testing.T, b EditBuffer, pos int, e_line int, e_col int) {
   l, c, success := b.GetCoordinates(pos)
-  if success != SUCCEEDED {
+  if success != nil {
     t.Error(fmt.Sprintf("Line/col of  position '%v' failed", pos))
   }
   if l != e_line {
@@ -342,42 +614,1718 @@ func ExpectLineAndColumn(t *testing.T, b EditBuffer, pos int, e_line int, e_col
 }
 
 func TestGetLineAndColumn(t *testing.T) {
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("aaaaabbbb\ncccccdddd\neeeeeffff\nggggghhhh\niiiiijjjj\n")
+    ExpectLineAndColumn(t, b, 23, 3, 3)
+    ExpectLineAndColumn(t, b, 35, 4, 5)
+    ExpectLineAndColumn(t, b, 5, 1, 5)
+    ExpectLineAndColumn(t, b, 10, 2, 0)
+    b.MoveCursorTo(25)
+    ExpectLineAndColumn(t, b, 23, 3, 3)
+    ExpectLineAndColumn(t, b, 35, 4, 5)
+    ExpectLineAndColumn(t, b, 5, 1, 5)
+    ExpectLineAndColumn(t, b, 10, 2, 0)
+  })
+}
+
+func TestColumnTrackingForward(t *testing.T) {
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("abc\ndefgh\n")
+    b.MoveCursorTo(0)
+    b.MoveCursorBy(7)
+    if b.GetCurrentColumn() != 3 {
+      t.Error(fmt.Sprintf("Expected column 3, but found %v", b.GetCurrentColumn()))
+    }
+  })
+}
+
+func TestGetRuneAt(t *testing.T) {
   b := NewBuffer(100)
-  b.InsertString("aaaaabbbb\ncccccdddd\neeeeeffff\nggggghhhh\niiiiijjjj\n")
-  ExpectLineAndColumn(t, b, 23, 3, 3)
-  ExpectLineAndColumn(t, b, 35, 4, 5)
-  ExpectLineAndColumn(t, b, 5, 1, 5)
-  ExpectLineAndColumn(t, b, 10, 2, 0)
-  b.MoveCursorTo(25)
-  ExpectLineAndColumn(t, b, 23, 3, 3)
-  ExpectLineAndColumn(t, b, 35, 4, 5)
-  ExpectLineAndColumn(t, b, 5, 1, 5)
-  ExpectLineAndColumn(t, b, 10, 2, 0)
+  b.InsertString("aé€😀")
+  expected := []struct { pos int; r rune; size int }{
+    {0, 'a', 1}, {1, 'é', 2}, {3, '€', 3}, {6, '😀', 4}, {2, 0xfffd, 1},
+  }
+  for _, e := range expected {
+    r, size, err := b.GetRuneAt(e.pos)
+    if err != nil || r != e.r || size != e.size {
+      t.Error(fmt.Sprintf("Expected rune %q (size %v) at %v, but found %q (size %v)",
+        e.r, e.size, e.pos, r, size))
+    }
+  }
+  if _, _, err := b.GetRuneAt(10); !errors.Is(err, PAST_END.Err()) {
+    t.Error("Retrieving a rune beyond buffer end should have failed")
+  }
 }
 
+func TestStepRunes(t *testing.T) {
+  b := NewBuffer(100)
+  b.InsertString("aé€😀b")
+  b.MoveCursorTo(0)
+  positions := []int{1, 3, 6, 10, 11}
+  for _, p := range positions {
+    b.StepRuneForward()
+    if b.GetCurrentPosition() != p {
+      t.Error(fmt.Sprintf("Expected to step forward to %v, but found %v", p,
+        b.GetCurrentPosition()))
+    }
+  }
+  if !errors.Is(b.StepRuneForward(), PAST_END.Err()) {
+    t.Error("Stepping past the end of the buffer should have failed")
+  }
+  for i := len(positions) - 2; i >= 0; i-- {
+    b.StepRuneBackward()
+    if b.GetCurrentPosition() != positions[i] {
+      t.Error(fmt.Sprintf("Expected to step backward to %v, but found %v", positions[i],
+        b.GetCurrentPosition()))
+    }
+  }
+}
+
+func TestRuneAndGraphemeColumns(t *testing.T) {
+  b := NewBuffer(100)
+  // "e" followed by a combining acute accent, and a flag.
+  b.InsertString("x\nnaïve e\u0301 🇫🇷 z")
+  pos := b.Length() - 1
+  _, bytecol, _ := b.GetCoordinates(pos)
+  line, runecol, _ := b.GetRuneCoordinates(pos)
+  _, gcol, _ := b.GetGraphemeCoordinates(pos)
+  if line != 2 || bytecol != 20 || runecol != 12 || gcol != 10 {
+    t.Error(fmt.Sprintf("Expected line 2, columns 20/12/10, but found line %v, columns %v/%v/%v",
+      line, bytecol, runecol, gcol))
+  }
+  b.MoveCursorTo(pos)
+  if b.GetCurrentRuneColumn() != 12 || b.GetCurrentGraphemeColumn() != 10 {
+    t.Error(fmt.Sprintf("Expected current columns 12/10, but found %v/%v",
+      b.GetCurrentRuneColumn(), b.GetCurrentGraphemeColumn()))
+  }
+}
 
 func TestRead(t *testing.T) {
-  f, status := NewFileBuffer("tests/foo")
-  if status != SUCCEEDED {
+  f, err := NewFileBuffer("tests/foo")
+  if err != nil {
     t.Error(fmt.Sprintf("Expected to be able to read file \"tests/foo\"; error '%v'.",
-      status))
+      err))
     return
   }
   ExpectBufferValue(t, f, "Hello world.\nThis is the second line.\nStuff and contents.\n\n", "")
 }
 
+func TestReadFailureKeepsBuffer(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "unreadable")
+  ioutil.WriteFile(filename, []uint8("text\n"), 0644)
+  f, _ := NewFileBuffer(filename)
+  f.InsertString("more\n")
+  ioutil.WriteFile(filename, []uint8{0xFF, 0xFE, 0x3D, 0xD8}, 0644)
+  if err := f.Read(); !errors.Is(err, ENCODING_ERROR.Err()) {
+    t.Error(fmt.Sprintf("Expected ENCODING_ERROR, got %v", err))
+  }
+  os.Remove(filename)
+  if err := f.Read(); !errors.Is(err, IO_ERROR.Err()) {
+    t.Error(fmt.Sprintf("Expected IO_ERROR, got %v", err))
+  }
+  ExpectStringEquals(t, "unread buffer", "text\nmore\n", f.String())
+  if encoding, _ := f.Encoding(); !f.IsDirty() || !f.CanUndo() || encoding != ENCODING_UTF8 {
+    t.Error("Expected a failed read to leave the buffer, its history and its encoding alone")
+  }
+}
+
 func TestWrite(t *testing.T) {
-  f, status := NewFileBuffer("tests/foo")
-  if status != SUCCEEDED {
+  f, err := NewFileBuffer("tests/foo")
+  if err != nil {
     t.Error(fmt.Sprintf("Expected to be able to read file %v; error '%v'.", f.GetFilename(),
-      status))
+      err))
   }
-  f.filename = "tests/foo2"
+  if f.IsDirty() {
+    t.Error("Expected a buffer that was just read to be clean")
+  }
+  f.filename = filepath.Join(t.TempDir(), "foo2")
+  if s := f.Write(); s != nil || fileExists(f.filename) {
+    t.Error(fmt.Sprintf("Expected writing an unedited buffer to do nothing, got '%v'", s))
+  }
+  f.InsertString("More stuff.\n")
   s := f.Write()
-  if s != SUCCEEDED {
+  if s != nil {
     t.Error(fmt.Sprintf("Error writing file '%v', error was '%v'", f.filename,
       s))
   }
+  contents, _ := ioutil.ReadFile(f.filename)
+  ExpectStringEquals(t, "written file",
+    "Hello world.\nThis is the second line.\nStuff and contents.\n\nMore stuff.\n", string(contents))
+}
+
+func TestPersistentUndo(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "hist")
+  ioutil.WriteFile(filename, []uint8("Hello world.\n"), 0600)
+  f, err := NewFileBufferWithHistory(filename)
+  if err != nil {
+    t.Fatal(fmt.Sprintf("Expected to be able to read file %v; error '%v'.", filename, err))
+  }
+  if f.CanUndo() {
+    t.Error("Expected reading a file not to be undoable")
+  }
+  f.MoveCursorTo(6)
+  f.Cut(5)
+  f.InsertString("there")
+  f.Undo()
+  f.BeginUndoGroup()
+  f.InsertString("apex")
+  f.InsertChar('!')
+  f.EndUndoGroup()
+  if s := f.Write(); s != nil {
+    t.Fatal(fmt.Sprintf("Error writing file '%v', error was '%v'", filename, s))
+  }
+
+  if info, err := os.Stat(UndoFileName(filename)); err != nil || info.Mode().Perm() != 0600 {
+    t.Error(fmt.Sprintf("Expected the undo file to be private, like the file; got %v", info))
+  }
+
+  g, _ := NewFileBufferWithHistory(filename)
+  ExpectStringEquals(t, "reloaded buffer", "Hello apex!.\n", g.String())
+  if len(g.UndoBranches()) != 2 {
+    t.Error(fmt.Sprintf("Expected 2 undo branches, but found %v", len(g.UndoBranches())))
+  }
+  g.Undo()
+  ExpectStringEquals(t, "undone buffer", "Hello .\n", g.String())
+  g.Undo()
+  ExpectStringEquals(t, "undone buffer", "Hello world.\n", g.String())
+  g.Redo()
+  g.Redo()
+  ExpectStringEquals(t, "redone buffer", "Hello apex!.\n", g.String())
+}
+
+func TestPersistentUndoStale(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "hist")
+  ioutil.WriteFile(filename, []uint8("Hello world.\n"), 0644)
+  f, _ := NewFileBufferWithHistory(filename)
+  f.InsertString("abc")
+  f.Write()
+  os.Remove(filename)
+  ioutil.WriteFile(filename, []uint8("Changed elsewhere.\n"), 0644)
+  g, _ := NewFileBufferWithHistory(filename)
+  if g.CanUndo() {
+    t.Error("Expected undo history for a modified file to be discarded")
+  }
+}
+
+func TestPieceTableFile(t *testing.T) {
+  p, err := NewPieceTableFile("tests/foo")
+  if err != nil {
+    t.Fatal(fmt.Sprintf("Expected to be able to read file \"tests/foo\"; error '%v'.", err))
+  }
+  original := p.String()
+  p.MoveToLine(2)
+  p.Cut(11)
+  p.InsertString("Here is")
+  p.InsertString(" the")
+  ExpectStringEquals(t, "edited buffer",
+    "Hello world.\nHere is the second line.\nStuff and contents.\n\n", p.String())
+  if string(p.original) != original {
+    t.Error("Expected the original text of a piece table to be unchanged")
+  }
+  for p.CanUndo() {
+    p.Undo()
+  }
+  ExpectStringEquals(t, "undone buffer", original, p.String())
+}
+
+func TestRopeMatchesGapBuffer(t *testing.T) {
+  r := NewRope()
+  g := NewBuffer(100)
+  rng := rand.New(rand.NewSource(1))
+  line := []uint8("the quick brown fox jumps over the lazy dog\n")
+  for i := 0; i < 2000; i++ {
+    pos := rng.Intn(g.Length() + 1)
+    r.MoveCursorTo(pos)
+    g.MoveCursorTo(pos)
+    if rng.Intn(3) == 0 {
+      n := rng.Intn(200) - 100
+      ExpectStringEquals(t, "cut text", string(g.Cut(n)), string(r.Cut(n)))
+    } else {
+      text := line[rng.Intn(len(line)):]
+      r.InsertChars(text)
+      g.InsertChars(text)
+    }
+  }
+  ExpectStringEquals(t, "rope contents", g.String(), r.String())
+  if r.LineCount() != g.LineCount() {
+    t.Error(fmt.Sprintf("Expected %v lines, but found %v", g.LineCount(), r.LineCount()))
+  }
+  pos := g.Length() / 2
+  gl, gc, _ := g.GetCoordinates(pos)
+  rl, rc, _ := r.GetCoordinates(pos)
+  if gl != rl || gc != rc {
+    t.Error(fmt.Sprintf("Expected %v:%v, but found %v:%v", gl, gc, rl, rc))
+  }
+  // An AVL tree's height is at most about 1.44 log2(n).
+  leaves := r.Length()/ropeLeafSize + 1
+  limit := 2
+  for n := 1; n < leaves; n *= 2 {
+    limit += 2
+  }
+  if r.root.height > limit {
+    t.Error(fmt.Sprintf("Rope height %v is more than %v", r.root.height, limit))
+  }
+  for r.CanUndo() {
+    r.Undo()
+  }
+  ExpectStringEquals(t, "undone rope", "", r.String())
+}
+
+func TestOpenFileBuffer(t *testing.T) {
+  defer func(old int64) { RopeThreshold = old }(RopeThreshold)
+  RopeThreshold = 1 << 20
+  b, _ := OpenFileBuffer("tests/foo")
+  if _, ok := b.(*GapBuffer); !ok {
+    t.Error("Expected a small file to be opened as a gap buffer")
+  }
+  RopeThreshold = 10
+  b, _ = OpenFileBuffer("tests/foo")
+  if _, ok := b.(*Rope); !ok {
+    t.Error("Expected a large file to be opened as a rope")
+  }
+  ExpectStringEquals(t, "rope contents",
+    "Hello world.\nThis is the second line.\nStuff and contents.\n\n", b.(*Rope).String())
+  if b.GetFilename() != "tests/foo" || b.IsDirty() {
+    t.Error("Expected an opened file to know its name, and to be clean")
+  }
+  if b, err := OpenFileBuffer(filepath.Join(t.TempDir(), "missing")); b != nil || err == nil {
+    t.Error(fmt.Sprintf("Expected no buffer for a missing file, got %v/%v", b, err))
+  }
+  // Every kind of buffer that can hold a file is a FileBuffer.
+  var _ FileBuffer = (*MappedBuffer)(nil)
+  for _, b := range []FileBuffer{NewBuffer(0), NewRope(), NewPieceTable(0)} {
+    if b.GetFilename() != "" {
+      t.Error("Expected a new buffer to have no file")
+    }
+  }
+}
+
+func TestRopeWrite(t *testing.T) {
+  defer func(old int64) { RopeThreshold = old }(RopeThreshold)
+  RopeThreshold = 0
+  dir := t.TempDir()
+  for _, c := range []struct{ contents, edited string }{
+    {"one\ntwo\n", "one\nthree\ntwo\n"},
+    {"one\r\ntwo\r\n", "one\r\nthree\r\ntwo\r\n"},
+    {"one\r\ntwo\n", "one\r\nthree\ntwo\n"},
+    {"\xff\xfeo\x00n\x00e\x00\n\x00t\x00w\x00o\x00\n\x00",
+      "\xff\xfeo\x00n\x00e\x00\n\x00t\x00h\x00r\x00e\x00e\x00\n\x00t\x00w\x00o\x00\n\x00"},
+  } {
+    filename := filepath.Join(dir, "rope")
+    os.WriteFile(filename, []uint8(c.contents), 0600)
+    r, err := OpenFileBuffer(filename)
+    if _, ok := r.(*Rope); err != nil || !ok {
+      t.Fatalf("Expected %q to open as a rope, got %v", c.contents, err)
+    }
+    if r.IsDirty() {
+      t.Errorf("Expected a rope that was just read to be clean")
+    }
+    r.MoveToLine(2)
+    r.InsertString("three\n")
+    if err := r.Write(); err != nil {
+      t.Errorf("Expected write of %q to succeed, got %v", c.contents, err)
+    }
+    contents, _ := os.ReadFile(filename)
+    ExpectStringEquals(t, "written rope", c.edited, string(contents))
+    if r.IsDirty() {
+      t.Errorf("Expected a rope that was just written to be clean")
+    }
+    if info, _ := os.Stat(filename); info.Mode().Perm() != 0600 {
+      t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+    }
+    os.Remove(filename + ".bak")
+  }
+
+  filename := filepath.Join(dir, "changed")
+  os.WriteFile(filename, []uint8("one\n"), 0644)
+  r, _ := NewRopeFile(filename)
+  r.InsertString("zero\n")
+  os.WriteFile(filename, []uint8("other program\n"), 0644)
+  if changed, _ := r.ChangedOnDisk(); !changed {
+    t.Errorf("Expected the rope to notice that its file changed")
+  }
+  if err := r.Write(); !errors.Is(err, FILE_CHANGED.Err()) {
+    t.Errorf("Expected FILE_CHANGED, got %v", err)
+  }
+  if err := r.ForceWrite(); err != nil {
+    t.Errorf("Expected forced write to succeed, got %v", err)
+  }
+  contents, _ := os.ReadFile(filename)
+  ExpectStringEquals(t, "forced write", "zero\none\n", string(contents))
+  backup, _ := os.ReadFile(filename + ".bak")
+  ExpectStringEquals(t, "backup", "other program\n", string(backup))
+  r.InsertString("x")
+  if err := r.Read(); err != nil || r.IsDirty() || r.CanUndo() {
+    t.Errorf("Expected read to leave a clean rope with no undo, got %v", err)
+  }
+  ExpectStringEquals(t, "reread rope", "zero\none\n", r.String())
+}
+
+func TestMappedFileBuffer(t *testing.T) {
+  m, err := NewMappedFileBuffer("tests/foo")
+  if err != nil {
+    t.Fatal(fmt.Sprintf("Expected to be able to map file \"tests/foo\"; error '%v'.", err))
+  }
+  ExpectLinePosition(t, m, 3, 38)
+  m.MoveToLine(3)
+  m.InsertString("More ")
+  ExpectChars(t, m, 38, 49, "More Stuff ")
+  m.Undo()
+  ExpectStringEquals(t, "mapped buffer",
+    "Hello world.\nThis is the second line.\nStuff and contents.\n\n", m.String())
+  if m.Close() != nil {
+    t.Error("Expected closing a mapped buffer to succeed")
+  }
+}
+
+func TestMappedFileWrite(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "mapped")
+  ioutil.WriteFile(filename, []uint8("one\ntwo\n"), 0600)
+  m, err := NewMappedFileBuffer(filename)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer m.Close()
+  m.MoveToLine(2)
+  m.InsertString("one and a half\n")
+  if err := m.Write(); err != nil {
+    t.Fatal(fmt.Sprintf("Expected to be able to write a mapped file, got %v", err))
+  }
+  contents, _ := ioutil.ReadFile(filename)
+  ExpectStringEquals(t, "written file", "one\none and a half\ntwo\n", string(contents))
+  ExpectStringEquals(t, "remapped buffer", "one\none and a half\ntwo\n", m.String())
+  if m.IsDirty() || m.CanUndo() {
+    t.Error("Expected a saved mapped buffer to be clean, with no history")
+  }
+  if info, _ := os.Stat(filename); info.Mode().Perm() != 0600 {
+    t.Error(fmt.Sprintf("Expected the file to stay private, got %v", info.Mode()))
+  }
+  backup, _ := ioutil.ReadFile(filename + ".bak")
+  ExpectStringEquals(t, "backup", "one\ntwo\n", string(backup))
+
+  m.InsertString("zero\n")
+  ioutil.WriteFile(filename, []uint8("changed\n"), 0600)
+  if err := m.Write(); !errors.Is(err, FILE_CHANGED.Err()) {
+    t.Error(fmt.Sprintf("Expected FILE_CHANGED, got %v", err))
+  }
+  if err := m.Read(); err != nil || m.IsDirty() {
+    t.Error(fmt.Sprintf("Expected to re-read the file cleanly, got %v", err))
+  }
+  ExpectStringEquals(t, "re-read buffer", "changed\n", m.String())
+
+  p, _ := NewPieceTableFile(filename)
+  p.MoveCursorTo(0)
+  p.InsertString("un")
+  if err := p.Write(); err != nil {
+    t.Error(fmt.Sprintf("Expected to be able to write a piece table, got %v", err))
+  }
+  q, _ := NewPieceTableFile(filename)
+  ExpectStringEquals(t, "re-read piece table", "unchanged\n", q.String())
+}
+
+// Check the line index of a large mapped file, which spans several
+// index blocks, against a gap buffer with the same edits, and search
+// it.
+func TestMappedFileLines(t *testing.T) {
+  rng := rand.New(rand.NewSource(3))
+  var text []uint8
+  for len(text) < 3*lineIndexBlock {
+    text = append(text, strings.Repeat("x", rng.Intn(200))...)
+    text = append(text, '\n')
+  }
+  filename := filepath.Join(t.TempDir(), "big")
+  os.WriteFile(filename, text, 0644)
+  m, err := NewMappedFileBuffer(filename)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer m.Close()
+  g := NewBuffer(len(text))
+  g.InsertChars(text)
+  for i := 0; i < 50; i++ {
+    pos := rng.Intn(g.Length() + 1)
+    m.MoveCursorTo(pos)
+    g.MoveCursorTo(pos)
+    insert := []string{"y", "\n", "a\nb\n", "\xc3", "\xa9"}[rng.Intn(5)]
+    m.InsertString(insert)
+    g.InsertString(insert)
+  }
+  // An "é" whose bytes are in two different pieces.
+  for _, b := range []string{"\xa9", "\xc3"} {
+    m.MoveCursorTo(10)
+    g.MoveCursorTo(10)
+    m.InsertString(b)
+    g.InsertString(b)
+  }
+  ExpectStringEquals(t, "edited mapped file", g.String(), m.String())
+  if m.LineCount() != g.LineCount() {
+    t.Errorf("Expected %d lines, got %d", g.LineCount(), m.LineCount())
+  }
+  for i := 0; i < 200; i++ {
+    pos := rng.Intn(g.Length() + 1)
+    line, col, _ := m.GetCoordinates(pos)
+    want_line, want_col, _ := g.GetCoordinates(pos)
+    if line != want_line || col != want_col {
+      t.Errorf("Expected %d to be at %d:%d, got %d:%d", pos, want_line, want_col, line, col)
+    }
+    linenum := rng.Intn(g.LineCount() + 2)
+    got, err := m.GetPositionOfLine(linenum)
+    want, want_err := g.GetPositionOfLine(linenum)
+    if got != want || (err == nil) != (want_err == nil) {
+      t.Errorf("Expected line %d at %d (%v), got %d (%v)", linenum, want, want_err, got, err)
+    }
+  }
+  m.MoveCursorTo(g.Length())
+  g.MoveCursorTo(g.Length())
+  for m.StepCursorBackward() == nil {
+    g.StepCursorBackward()
+    if m.GetCurrentLine() != g.GetCurrentLine() || m.GetCurrentColumn() != g.GetCurrentColumn() {
+      t.Fatalf("Expected cursor at %d:%d, got %d:%d", g.GetCurrentLine(), g.GetCurrentColumn(),
+        m.GetCurrentLine(), m.GetCurrentColumn())
+    }
+  }
+
+  for _, pattern := range []string{`(?m)^x{199}$`, `xé`, `y+`, `a\nb`, `\xff|\x{fffd}`} {
+    re := regexp.MustCompile(pattern)
+    want := re.FindAllIndex(g.Bytes(), -1)
+    got := m.FindAll(re, -1)
+    if len(got) != len(want) {
+      t.Errorf("Expected %d matches of %s, got %d", len(want), pattern, len(got))
+      continue
+    }
+    for i, loc := range want {
+      if got[i].Start != loc[0] || got[i].End != loc[1] {
+        t.Errorf("Expected match of %s at %v, got %d-%d", pattern, loc, got[i].Start, got[i].End)
+      }
+    }
+    if len(want) > 0 {
+      last, _ := m.FindBackward(re, m.Length())
+      if last == nil || last.Start != want[len(want)-1][0] {
+        t.Errorf("Expected last match of %s at %d, got %v", pattern, want[len(want)-1][0], last)
+      }
+    }
+  }
+}
+
+// Check the gap buffer, including its newline index, against a plain
+// string after a long series of random edits and cursor motions.
+func TestGapBufferRandomEdits(t *testing.T) {
+  b := NewBuffer(16)
+  model := ""
+  rng := rand.New(rand.NewSource(2))
+  for i := 0; i < 3000; i++ {
+    pos := rng.Intn(len(model) + 1)
+    b.MoveCursorTo(pos)
+    switch rng.Intn(4) {
+    case 0:
+      n := rng.Intn(20)
+      if pos+n > len(model) {
+        n = len(model) - pos
+      }
+      b.Cut(n)
+      model = model[:pos] + model[pos+n:]
+    case 1:
+      n := rng.Intn(20)
+      if n > pos {
+        n = pos
+      }
+      b.Cut(-n)
+      model = model[:pos-n] + model[pos:]
+    default:
+      text := "ab\ncd\n\nef"[rng.Intn(10):]
+      b.InsertString(text)
+      model = model[:pos] + text + model[pos:]
+    }
+    pos = b.GetCurrentPosition()
+    line := strings.Count(model[:pos], "\n") + 1
+    col := pos - strings.LastIndex(model[:pos], "\n") - 1
+    if b.GetCurrentLine() != line || b.GetCurrentColumn() != col {
+      t.Fatal(fmt.Sprintf("After edit %v, expected cursor at %v:%v, but found %v:%v",
+        i, line, col, b.GetCurrentLine(), b.GetCurrentColumn()))
+    }
+  }
+  ExpectStringEquals(t, "buffer", model, b.String())
+  for pos := 0; pos <= len(model); pos++ {
+    ExpectLineAndColumn(t, b, pos, strings.Count(model[:pos], "\n")+1,
+      pos-strings.LastIndex(model[:pos], "\n")-1)
+  }
+}
+
+func ExpectMark(t *testing.T, b *GapBuffer, name string, expected int) {
+  pos, err := b.GetMark(name)
+  if err != nil {
+    t.Error(fmt.Sprintf("Mark '%v' wasn't found", name))
+  } else if pos != expected {
+    t.Error(fmt.Sprintf("Expected mark '%v' at %v, but found %v", name, expected, pos))
+  }
+}
+
+func TestMarks(t *testing.T) {
+  b := NewBuffer(100)
+  b.InsertString("0123456789")
+  b.SetMark("left", 5)
+  b.SetMarkWithGravity("right", 5, RIGHT_GRAVITY)
+  b.SetMark("end", 9)
+  b.SetMark("start", 2)
+  b.MoveCursorTo(5)
+  b.InsertString("abc")
+  ExpectMark(t, b, "left", 5)
+  ExpectMark(t, b, "right", 8)
+  ExpectMark(t, b, "end", 12)
+  ExpectMark(t, b, "start", 2)
+  b.MoveCursorTo(0)
+  b.InsertChar('x')
+  ExpectMark(t, b, "left", 6)
+  ExpectMark(t, b, "start", 3)
+  // Cut "45abc67", which contains the left and right marks.
+  b.MoveCursorTo(5)
+  b.Cut(7)
+  ExpectMark(t, b, "left", 5)
+  ExpectMark(t, b, "right", 5)
+  ExpectMark(t, b, "end", 6)
+  b.MoveCursorTo(3)
+  b.Cut(-2)
+  ExpectMark(t, b, "start", 1)
+  ExpectMark(t, b, "end", 4)
+  if b.DeleteMark("start") != nil {
+    t.Error("Expected deleting a mark to succeed")
+  }
+  if _, err := b.GetMark("start"); err == nil {
+    t.Error("Expected a deleted mark not to be found")
+  }
+  if b.SetMark("bad", 100) == nil {
+    t.Error("Expected setting a mark past the end of the buffer to fail")
+  }
+}
+
+func TestMarksFollowUndo(t *testing.T) {
+  b := NewBuffer(100)
+  b.InsertString("hello world")
+  b.SetMark("w", 6)
+  b.MoveCursorTo(0)
+  b.InsertString(">> ")
+  ExpectMark(t, b, "w", 9)
+  b.Undo()
+  ExpectMark(t, b, "w", 6)
+  b.Redo()
+  ExpectMark(t, b, "w", 9)
+}
+
+func ExpectSelection(t *testing.T, b *GapBuffer, front int, tail int) {
+  sel := b.GetSelection()
+  if sel.Front() != front || sel.Tail() != tail {
+    t.Error(fmt.Sprintf("Expected selection %v-%v, but found %v-%v", front, tail,
+      sel.Front(), sel.Tail()))
+  }
+}
+
+func TestSelection(t *testing.T) {
+  b := NewBuffer(100)
+  b.InsertString("one two three four")
+  b.SelectRange(4, 7)
+  ExpectStringEquals(t, "selection", "two", string(b.CopySelection()))
+  b.ExtendTail(6)
+  ExpectStringEquals(t, "selection", "two three", string(b.CopySelection()))
+  b.ExtendFront(-4)
+  ExpectSelection(t, b, 0, 13)
+  if b.ExtendFront(20) == nil {
+    t.Error("Expected moving the front past the tail to fail")
+  }
+  b.SelectRange(4, 7)
+  // Edits before the selection move it; edits after it don't.
+  b.MoveCursorTo(0)
+  b.InsertString(">> ")
+  b.MoveCursorTo(b.Length())
+  b.InsertString(" <<")
+  ExpectSelection(t, b, 7, 10)
+  b.ReplaceSelection("TWO, 2")
+  ExpectStringEquals(t, "buffer", ">> one TWO, 2 three four <<", b.String())
+  ExpectSelection(t, b, 7, 13)
+  b.Undo()
+  ExpectStringEquals(t, "buffer", ">> one two three four <<", b.String())
+  b.InsertBeforeSelection("[")
+  b.AppendToSelection("]")
+  ExpectStringEquals(t, "buffer", ">> one [two] three four <<", b.String())
+  ExpectSelection(t, b, 8, 11)
+  ExpectStringEquals(t, "cut", "two", string(b.CutSelection()))
+  ExpectSelection(t, b, 8, 8)
+  b.AppendToSelection("2")
+  b.InsertBeforeSelection("1")
+  ExpectStringEquals(t, "buffer", ">> one [12] three four <<", b.String())
+  ExpectSelection(t, b, 9, 9)
+  b.SelectAll()
+  ExpectSelection(t, b, 0, b.Length())
+}
+
+func ExpectCursors(t *testing.T, b *GapBuffer, expected ...int) {
+  var found []int
+  for _, c := range b.Cursors() {
+    found = append(found, c.Front(), c.Tail())
+  }
+  if fmt.Sprint(found) != fmt.Sprint(expected) {
+    t.Error(fmt.Sprintf("Expected cursors %v, but found %v", expected, found))
+  }
+}
+
+func TestMultipleCursors(t *testing.T) {
+  b := NewBuffer(100)
+  b.InsertString("one\ntwo\nsix\n")
+  b.MoveCursorTo(0)
+  b.AddCursor(4)
+  b.AddCursor(8)
+  b.InsertString("> ")
+  ExpectBufferValue(t, b, "> ", "one\n> two\n> six\n")
+  ExpectCursors(t, b, 2, 2, 8, 8, 14, 14)
+  b.Undo()
+  ExpectStringEquals(t, "buffer", "one\ntwo\nsix\n", b.String())
+  ExpectCursors(t, b, 0, 0, 4, 4, 8, 8)
+  b.Redo()
+  ExpectStringEquals(t, "buffer", "> one\n> two\n> six\n", b.String())
+  b.MoveCursorBy(3)
+  ExpectCursors(t, b, 5, 5, 11, 11, 17, 17)
+  ExpectStringEquals(t, "cut", "one", string(b.Cut(-3)))
+  ExpectBufferValue(t, b, "> ", "\n> \n> \n")
+  ExpectCursors(t, b, 2, 2, 5, 5, 8, 8)
+  b.Undo()
+  ExpectStringEquals(t, "buffer", "> one\n> two\n> six\n", b.String())
+  // Empty cursors end up after text restored at them by undo.
+  ExpectCursors(t, b, 5, 5, 11, 11, 17, 17)
+  // Edits at a given position only happen at the gap.
+  b.InsertStringAt(0, "#")
+  ExpectStringEquals(t, "buffer", "#> one\n> two\n> six\n", b.String())
+  ExpectCursors(t, b, 6, 6, 12, 12, 18, 18)
+  b.ClearCursors()
+  if b.HasMultipleCursors() {
+    t.Error("Expected a single cursor after ClearCursors")
+  }
+  b.InsertString("!")
+  ExpectStringEquals(t, "buffer", "#> one!\n> two\n> six\n", b.String())
+
+  // Text inserted at the cursors by redo isn't selected, so the next
+  // insert doesn't replace it.
+  c := NewBuffer(100)
+  c.InsertString("one\ntwo\nthree\n")
+  c.MoveCursorTo(0)
+  c.AddCursor(4)
+  c.AddCursor(8)
+  c.InsertString("> ")
+  c.Undo()
+  c.Redo()
+  c.InsertString("#")
+  ExpectStringEquals(t, "buffer", "> #one\n> #two\n> #three\n", c.String())
+  // Moving the gap leaves the cursors where they are.
+  c.MoveCursorTo(0)
+  c.InsertString("$")
+  ExpectStringEquals(t, "buffer", "> #$one\n> #$two\n> #$three\n", c.String())
+}
+
+func TestSelectionCursors(t *testing.T) {
+  b := NewBuffer(100)
+  b.InsertString("one two one")
+  b.MoveCursorTo(0)
+  b.AddSelectionCursor(8, 11)
+  // The primary cursor is merged with a selection that starts there.
+  b.AddSelectionCursor(0, 3)
+  ExpectCursors(t, b, 0, 3, 8, 11)
+  b.InsertString("1")
+  ExpectStringEquals(t, "buffer", "1 two 1", b.String())
+  ExpectCursors(t, b, 1, 1, 7, 7)
+  b.AddSelectionCursor(2, 5)
+  // Empty cursors cut forward; the others cut their selections.
+  ExpectStringEquals(t, "cut", " ", string(b.Cut(1)))
+  ExpectStringEquals(t, "buffer", "1 1", b.String())
+  b.Undo()
+  b.Undo()
+  ExpectStringEquals(t, "buffer", "one two one", b.String())
+}
+
+func TestMergeCursors(t *testing.T) {
+  b := NewBuffer(100)
+  b.InsertString("abcdefgh")
+  b.MoveCursorTo(0)
+  b.AddSelectionCursor(4, 6)
+  b.AddSelectionCursor(2, 5)
+  ExpectCursors(t, b, 0, 0, 2, 6)
+  b.AddCursor(6)
+  ExpectCursors(t, b, 0, 0, 2, 6)
+  b.AddCursor(1)
+  ExpectCursors(t, b, 0, 0, 1, 1, 2, 6)
+  // Moving the cursors collapses the selections, and cursors that
+  // meet are merged.
+  b.StepCursorBackward()
+  ExpectCursors(t, b, 0, 0, 5, 5)
+  b.StepCursorBackward()
+  ExpectCursors(t, b, 0, 0, 4, 4)
+  b.MoveCursorBy(-10)
+  if b.HasMultipleCursors() || len(b.Cursors()) != 0 {
+    t.Error("Expected the cursors to merge into one")
+  }
+  if b.GetCurrentPosition() != 0 {
+    t.Error(fmt.Sprintf("Expected the cursor at 0, but found %v", b.GetCurrentPosition()))
+  }
+}
+
+func ExpectEvent(t *testing.T, e ChangeEvent, kind ChangeKind, pos int, deleted string,
+  inserted string, start int, old_end int, new_end int) {
+  if e.Kind != kind || e.Position != pos || string(e.Deleted) != deleted ||
+    string(e.Inserted) != inserted || e.StartLine != start ||
+    e.OldEndLine != old_end || e.NewEndLine != new_end {
+    t.Error(fmt.Sprintf("Expected event {%v %v %q %q %v %v %v}, but found {%v %v %q %q %v %v %v}",
+      kind, pos, deleted, inserted, start, old_end, new_end,
+      e.Kind, e.Position, string(e.Deleted), string(e.Inserted), e.StartLine,
+      e.OldEndLine, e.NewEndLine))
+  }
+}
+
+func TestChangeEvents(t *testing.T) {
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    var events []ChangeEvent
+    calls := 0
+    id := b.Subscribe(ChangeFunc(func(es []ChangeEvent) {
+      calls++
+      events = append(events, es...)
+    }))
+    b.InsertString("one\ntwo\nthree")
+    b.MoveCursorTo(6)
+    b.Cut(-4)
+    b.Undo()
+    b.Redo()
+    if calls != 4 || len(events) != 4 {
+      t.Fatal(fmt.Sprintf("Expected 4 events in 4 calls, but found %v in %v", len(events), calls))
+    }
+    ExpectEvent(t, events[0], EDIT_CHANGE, 0, "", "one\ntwo\nthree", 1, 1, 3)
+    ExpectEvent(t, events[1], EDIT_CHANGE, 2, "e\ntw", "", 1, 2, 1)
+    ExpectEvent(t, events[2], UNDO_CHANGE, 2, "", "e\ntw", 1, 1, 2)
+    ExpectEvent(t, events[3], REDO_CHANGE, 2, "e\ntw", "", 1, 2, 1)
+    // A batch is delivered in one call, when the outermost batch ends.
+    events = nil
+    b.BeginChangeBatch()
+    b.InsertString("X")
+    b.BeginChangeBatch()
+    b.InsertString("Y")
+    b.EndChangeBatch()
+    if len(events) != 0 {
+      t.Error("Expected no events until the batch ended")
+    }
+    b.EndChangeBatch()
+    if calls != 5 || len(events) != 2 {
+      t.Error(fmt.Sprintf("Expected 2 events in one call, but found %v", len(events)))
+    }
+    if !errors.Is(b.EndChangeBatch(), INVALID.Err()) {
+      t.Error("Expected ending a batch that wasn't started to fail")
+    }
+    b.Unsubscribe(id)
+    b.InsertString("Z")
+    if calls != 5 {
+      t.Error("Expected no events after unsubscribing")
+    }
+  })
 }
 
+func TestChangeEventsForGroups(t *testing.T) {
+  b := NewBuffer(100)
+  var batches [][]ChangeEvent
+  b.Subscribe(ChangeFunc(func(es []ChangeEvent) { batches = append(batches, es) }))
+  b.InsertString("abc")
+  b.BeginUndoGroup()
+  b.InsertString("d")
+  b.Cut(-2)
+  b.EndUndoGroup()
+  b.Undo()
+  if len(batches) != 3 || len(batches[1]) != 2 || len(batches[2]) != 2 {
+    t.Fatal(fmt.Sprintf("Expected the group's events to be batched, but found %v", batches))
+  }
+  ExpectEvent(t, batches[2][0], UNDO_CHANGE, 2, "", "cd", 1, 1, 1)
+  ExpectEvent(t, batches[2][1], UNDO_CHANGE, 3, "d", "", 1, 1, 1)
+  batches = nil
+  b.filename = "tests/foo"
+  b.Read()
+  if len(batches) != 1 || len(batches[0]) != 2 {
+    t.Fatal(fmt.Sprintf("Expected the reload to be one batch, but found %v", batches))
+  }
+  ExpectEvent(t, batches[0][0], RELOAD_CHANGE, 0, "abc", "", 1, 1, 1)
+  ExpectEvent(t, batches[0][1], RELOAD_CHANGE, 0, "",
+    "Hello world.\nThis is the second line.\nStuff and contents.\n\n", 1, 1, 5)
+}
 
+func TestSnapshot(t *testing.T) {
+  for _, b := range []EditBuffer{NewBuffer(10), NewRope()} {
+    s := NewSyncBuffer(b)
+    s.InsertString("one\ntwo\n")
+    snap := s.Snapshot()
+    if s.Snapshot() != snap {
+      t.Error("Expected snapshots of the same version to be shared")
+    }
+    s.MoveCursorTo(4)
+    if s.Snapshot() != snap {
+      t.Error("Expected moving the cursor not to change the version")
+    }
+    s.InsertString("one and a half\n")
+    if snap.Version() == s.Version() {
+      t.Error("Expected an edit to change the version")
+    }
+    ExpectStringEquals(t, "snapshot", "one\ntwo\n", snap.String())
+    ExpectStringEquals(t, "new snapshot", "one\none and a half\ntwo\n", s.Snapshot().String())
+    if pos, _ := snap.GetPositionOfLine(2); pos != 4 || snap.LineCount() != 3 {
+      t.Error(fmt.Sprintf("Expected line 2 of 3 at 4, but found %v of %v", pos, snap.LineCount()))
+    }
+    snap = s.Snapshot()
+    for pos := 0; pos <= b.Length(); pos++ {
+      line, col, _ := snap.GetCoordinates(pos)
+      want_line, want_col, _ := b.GetCoordinates(pos)
+      if line != want_line || col != want_col {
+        t.Error(fmt.Sprintf("Expected %v to be at %v:%v, but found %v:%v", pos, want_line, want_col, line, col))
+      }
+    }
+    for line := 0; line <= 5; line++ {
+      pos, err := snap.GetPositionOfLine(line)
+      want, want_err := b.GetPositionOfLine(line)
+      if pos != want || (err == nil) != (want_err == nil) {
+        t.Error(fmt.Sprintf("Expected line %v at %v, but found %v", line, want, pos))
+      }
+    }
+  }
+  // Snapshots check their bounds just like buffers do.
+  for _, b := range []EditBuffer{NewBuffer(10), NewRope()} {
+    s := NewSyncBuffer(b)
+    s.InsertString("abc")
+    snap := s.Snapshot()
+    for _, span := range [][2]int{{3, 3}, {1, 4}, {2, 1}, {0, 3}} {
+      _, snap_err := snap.GetRange(span[0], span[1])
+      _, err := b.GetRange(span[0], span[1])
+      if ResultCodeOf(snap_err) != ResultCodeOf(err) {
+        t.Error(fmt.Sprintf("Expected GetRange%v of a snapshot to give %v, but got %v", span, err, snap_err))
+      }
+    }
+  }
+  // A snapshot of a gap buffer is a version that shares its array.
+  g := NewBuffer(10)
+  g.InsertString("text")
+  if v, ok := NewSyncBuffer(g).Snapshot().text.(*BufferVersion); !ok || v != g.CurrentVersion() {
+    t.Error("Expected a snapshot of a gap buffer to be its current version")
+  }
+}
+
+func TestSyncBufferConcurrency(t *testing.T) {
+  s := NewSyncBuffer(NewBuffer(10))
+  done := make(chan bool)
+  for i := 0; i < 4; i++ {
+    go func(c uint8) {
+      for j := 0; j < 200; j++ {
+        s.Update(func(b EditBuffer) {
+          b.MoveCursorTo(b.Length())
+          b.InsertChar(c)
+        })
+      }
+      done <- true
+    }(uint8('a' + i))
+  }
+  go func() {
+    for j := 0; j < 200; j++ {
+      snap := s.Snapshot()
+      if text := snap.Bytes(); len(text) != snap.Length() {
+        t.Error("Expected a snapshot to be consistent")
+      }
+      s.View(func(b EditBuffer) { b.GetRange(0, b.Length()) })
+    }
+    done <- true
+  }()
+  for i := 0; i < 5; i++ {
+    <-done
+  }
+  if s.Length() != 800 || s.Version() != 800 {
+    t.Error(fmt.Sprintf("Expected 800 characters at version 800, but found %v at %v",
+      s.Length(), s.Version()))
+  }
+}
+
+func TestVersions(t *testing.T) {
+  b := NewBuffer(10)
+  b.InsertString("hello world")
+  b.MoveCursorTo(0)
+  b.InsertString(">> ")
+  b.MoveCursorTo(8)
+  b.Cut(6)
+  if b.Version() != 3 {
+    t.Error(fmt.Sprintf("Expected version 3, but found %v", b.Version()))
+  }
+  for version, expected := range []string{"", "hello world", ">> hello world", ">> hello"} {
+    v, _ := b.VersionAt(version)
+    ExpectStringEquals(t, fmt.Sprintf("version %v", version), expected, v.String())
+  }
+  if _, err := b.VersionAt(4); !errors.Is(err, PAST_END.Err()) {
+    t.Error("Expected a future version to be PAST_END")
+  }
+  // Offsets inside deleted text end up where it was; inserted text
+  // moves offsets according to their gravity.
+  for _, c := range []struct{ pos, version int; gravity Gravity; expected int }{
+    {6, 1, LEFT_GRAVITY, 8},
+    {0, 1, LEFT_GRAVITY, 0},
+    {0, 1, RIGHT_GRAVITY, 3},
+    {11, 1, LEFT_GRAVITY, 8},
+    {2, 2, LEFT_GRAVITY, 2},
+  } {
+    if pos, _ := b.MapOffset(c.pos, c.version, c.gravity); pos != c.expected {
+      t.Error(fmt.Sprintf("Expected %v at version %v to map to %v, but found %v",
+        c.pos, c.version, c.expected, pos))
+    }
+  }
+  // A version of the current text doesn't change when the buffer does.
+  current := b.CurrentVersion()
+  b.InsertString("!")
+  b.MoveCursorTo(0)
+  b.Undo()
+  ExpectStringEquals(t, "version 3", ">> hello", current.String())
+  ExpectStringEquals(t, "buffer", ">> hello", b.String())
+  if b.Version() != 5 {
+    t.Error(fmt.Sprintf("Expected undo to make version 5, but found %v", b.Version()))
+  }
+  b.DiscardVersionsBefore(3)
+  if _, err := b.VersionAt(2); !errors.Is(err, BEFORE_START.Err()) {
+    t.Error("Expected a discarded version to be BEFORE_START")
+  }
+  v, _ := b.VersionAt(4)
+  ExpectStringEquals(t, "version 4", ">> hello!", v.String())
+}
+
+func TestVersionsTrimmed(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "versions")
+  os.WriteFile(filename, []uint8("one\ntwo\n"), 0644)
+  b, _ := NewFileBuffer(filename)
+  b.SetBackupPolicy(BackupPolicy{Mode: BACKUP_NONE})
+  if len(b.version_log) != 0 {
+    t.Errorf("Expected reading a file not to be logged, found %d changes", len(b.version_log))
+  }
+  read := b.Version()
+  b.MoveCursorTo(0)
+  b.InsertString("zero\n")
+  b.Write()
+  if _, err := b.VersionAt(read); !errors.Is(err, BEFORE_START.Err()) {
+    t.Errorf("Expected versions before a save to be discarded, got %v", err)
+  }
+  // A version that's still in use keeps the log from being trimmed
+  // past it.
+  held := b.CurrentVersion()
+  b.MoveCursorTo(0)
+  b.InsertString("minus one\n")
+  b.Write()
+  if pos, err := b.MapOffset(5, held.Version(), LEFT_GRAVITY); err != nil || pos != 15 {
+    t.Errorf("Expected offset 5 of a held version to map to 15, got %d (%v)", pos, err)
+  }
+  v, _ := b.VersionAt(held.Version())
+  ExpectStringEquals(t, "held version", "zero\none\ntwo\n", v.String())
+  os.WriteFile(filename, []uint8("other\n"), 0644)
+  b.Read()
+  if v, _ := b.VersionAt(held.Version()); v == nil || v.String() != "zero\none\ntwo\n" {
+    t.Errorf("Expected a held version to survive reading the file")
+  }
+  runtime.KeepAlive(held)
+}
+
+func TestRandomVersions(t *testing.T) {
+  b := NewBuffer(16)
+  texts := []string{""}
+  var versions []*BufferVersion
+  rng := rand.New(rand.NewSource(3))
+  for i := 0; i < 300; i++ {
+    b.MoveCursorTo(rng.Intn(b.Length() + 1))
+    if rng.Intn(3) == 0 {
+      b.Cut(rng.Intn(20) - 10)
+    } else {
+      b.InsertString("ab\ncd\n\nef"[rng.Intn(10):])
+    }
+    for len(texts) <= b.Version() {
+      texts = append(texts, b.String())
+    }
+    if rng.Intn(10) == 0 {
+      versions = append(versions, b.CurrentVersion())
+    }
+  }
+  for version, expected := range texts {
+    v, _ := b.VersionAt(version)
+    ExpectStringEquals(t, fmt.Sprintf("version %v", version), expected, v.String())
+  }
+  for _, v := range versions {
+    ExpectStringEquals(t, fmt.Sprintf("shared version %v", v.Version()), texts[v.Version()], v.String())
+  }
+}
+
+func ExpectMatch(t *testing.T, m *Match, err error, spans ...int) {
+  if err != nil {
+    t.Error(fmt.Sprintf("Expected a match at %v, but the search failed with %v", spans, err))
+    return
+  }
+  var found []int
+  for _, g := range m.Groups {
+    found = append(found, g.Start, g.End)
+  }
+  if m.Start != spans[0] || m.End != spans[1] || fmt.Sprint(found) != fmt.Sprint(spans) {
+    t.Error(fmt.Sprintf("Expected match %v, but found %v-%v %v", spans, m.Start, m.End, found))
+  }
+}
+
+func TestFind(t *testing.T) {
+  b := NewBuffer(10)
+  b.InsertString("foo=1 bär=22\nbaz=333")
+  // Leave the gap in the middle of a match.
+  b.MoveCursorTo(8)
+  re := regexp.MustCompile(`(\pL+)=(\d+)|(x)`)
+  m, err := b.FindForward(re, 0)
+  ExpectMatch(t, m, err, 0, 5, 0, 3, 4, 5, -1, -1)
+  m, err = b.FindForward(re, 1)
+  ExpectMatch(t, m, err, 1, 5, 1, 3, 4, 5, -1, -1)
+  m, err = b.FindForward(re, 5)
+  ExpectMatch(t, m, err, 6, 13, 6, 10, 11, 13, -1, -1)
+  m, err = b.FindBackward(re, 14)
+  ExpectMatch(t, m, err, 6, 13, 6, 10, 11, 13, -1, -1)
+  m, err = b.FindBackward(re, 21)
+  ExpectMatch(t, m, err, 14, 21, 14, 17, 18, 21, -1, -1)
+  if _, err := b.FindBackward(re, 0); !errors.Is(err, MATCH_FAILED.Err()) {
+    t.Error("Expected no match before the start of the buffer")
+  }
+  if _, err := b.FindForward(regexp.MustCompile("qux"), 0); !errors.Is(err, MATCH_FAILED.Err()) {
+    t.Error("Expected MATCH_FAILED for a missing pattern")
+  }
+  if _, err := b.FindForward(re, 22); !errors.Is(err, PAST_END.Err()) {
+    t.Error("Expected a search past the end to fail")
+  }
+  matches := b.FindAll(re, -1)
+  if len(matches) != 3 || matches[2].Start != 14 {
+    t.Error(fmt.Sprintf("Expected 3 matches, but found %v", len(matches)))
+  }
+  if len(b.FindAll(re, 2)) != 2 {
+    t.Error("Expected FindAll to stop after 2 matches")
+  }
+  // Empty matches advance by whole runes, and aren't found right
+  // after another match. Anchors see the text before each match.
+  for _, text := range []string{"", "aaa", "foofoo bar", "foo=1 bär=22\nbaz=333"} {
+    c := NewBuffer(4)
+    c.InsertString(text)
+    c.MoveCursorTo(len(text) / 2)
+    for _, pattern := range []string{`\d*`, `^a`, `(?m)^\pL+`, `\bfoo`, `\B\pL`, `\pL+$`, `(?m)$`, `a|`} {
+      re := regexp.MustCompile(pattern)
+      var found [][]int
+      for _, m := range c.FindAll(re, -1) {
+        found = append(found, []int{m.Start, m.End})
+      }
+      expected := re.FindAllStringIndex(text, -1)
+      if fmt.Sprint(found) != fmt.Sprint(expected) {
+        t.Error(fmt.Sprintf("Expected matches %v of %q in %q, but found %v", expected, pattern, text, found))
+      }
+      if len(expected) > 0 {
+        last := expected[len(expected)-1]
+        m, err := c.FindBackward(re, len(text))
+        if last[0] < len(text) && (err != nil || m.Start != last[0] || m.End != last[1]) {
+          t.Error(fmt.Sprintf("Expected last match %v of %q in %q, but found %v", last, pattern, text, m))
+        }
+      }
+    }
+  }
+  if m, err := b.FindForward(regexp.MustCompile(`\b\w`), 1); err != nil || m.Start != 4 {
+    t.Error(fmt.Sprintf("Expected a search from the middle of a word to find the next word, but found %v", m))
+  }
+  if b.GetCurrentPosition() != 8 {
+    t.Error("Expected searching not to move the cursor")
+  }
+}
+
+func TestReplaceAll(t *testing.T) {
+  b := NewBuffer(10)
+  b.InsertString("x=1, y=22, z=333")
+  b.MoveCursorTo(11)
+  re := regexp.MustCompile(`(?P<name>\w)=(\d+)`)
+  if n := b.ReplaceAll(re, "$2:${name}", ReplaceOptions{}); n != 3 {
+    t.Error(fmt.Sprintf("Expected 3 replacements, but found %v", n))
+  }
+  // The cursor stays with the text it was next to.
+  ExpectBufferValue(t, b, "1:x, 22:y, ", "333:z")
+  b.Undo()
+  ExpectStringEquals(t, "buffer", "x=1, y=22, z=333", b.String())
+  b.ReplaceAll(re, "$2", ReplaceOptions{Literal: true, Limit: 2})
+  ExpectStringEquals(t, "buffer", "$2, $2, z=333", b.String())
+  if n := b.ReplaceAll(regexp.MustCompile("q"), "r", ReplaceOptions{}); n != 0 {
+    t.Error("Expected no replacements without a match")
+  }
+  // Anchored patterns replace what the regexp package would.
+  cases := []struct{ text, pattern, template string }{
+    {"aaa", `^a`, "b"},
+    {"foofoo bar foo", `\bfoo`, "[$0]"},
+    {"one\ntwo\nthree", `(?m)^`, "> "},
+    {"ab cd", `\B`, "-"},
+  }
+  for _, c := range cases {
+    b := NewBuffer(4)
+    b.InsertString(c.text)
+    re := regexp.MustCompile(c.pattern)
+    expected := string(re.ReplaceAll(b.Bytes(), []uint8(c.template)))
+    b.ReplaceAll(re, c.template, ReplaceOptions{})
+    ExpectStringEquals(t, fmt.Sprintf("%q replaced in %q", c.pattern, c.text), expected, b.String())
+  }
+}
+
+func TestReplacePreservingCase(t *testing.T) {
+  b := NewBuffer(10)
+  b.InsertString("foo Foo FOO fOo 42")
+  b.ReplaceAll(regexp.MustCompile(`(?i)foo`), "bar", ReplaceOptions{PreserveCase: true})
+  ExpectStringEquals(t, "buffer", "bar Bar BAR bar 42", b.String())
+}
+
+func TestReplaceNext(t *testing.T) {
+  b := NewBuffer(10)
+  b.InsertString("a-b-c")
+  re := regexp.MustCompile(`-`)
+  span, err := b.ReplaceNext(re, "+=", 0, ReplaceOptions{})
+  if err != nil || span.Start != 1 || span.End != 3 {
+    t.Error(fmt.Sprintf("Expected a replacement at 1-3, but found %v-%v", span.Start, span.End))
+  }
+  ExpectBufferValue(t, b, "a+=", "b-c")
+  b.ReplaceNext(re, "+=", span.End, ReplaceOptions{})
+  ExpectStringEquals(t, "buffer", "a+=b+=c", b.String())
+  if _, err := b.ReplaceNext(re, "+=", 0, ReplaceOptions{}); !errors.Is(err, MATCH_FAILED.Err()) {
+    t.Error("Expected MATCH_FAILED when there's nothing left to replace")
+  }
+  b.Undo()
+  ExpectStringEquals(t, "buffer", "a+=b-c", b.String())
+}
+
+func TestReader(t *testing.T) {
+  b := NewBuffer(10)
+  text := "one\ntwo ünï\nthree\n"
+  b.InsertString(text)
+  b.MoveCursorTo(7)
+  if err := iotest.TestReader(b.NewReader(), []uint8(text)); err != nil {
+    t.Error(err)
+  }
+  var lines []string
+  lines_in := bufio.NewScanner(b.NewReader())
+  for lines_in.Scan() {
+    lines = append(lines, lines_in.Text())
+  }
+  if fmt.Sprint(lines) != "[one two ünï three]" {
+    t.Error(fmt.Sprintf("Unexpected lines %q", lines))
+  }
+  r := b.NewReader()
+  r.Seek(-9, io.SeekEnd)
+  if c, size, _ := r.ReadRune(); c != 'ï' || size != 2 {
+    t.Error(fmt.Sprintf("Expected to read 'ï', but found %q", c))
+  }
+  r.UnreadRune()
+  if err := r.UnreadRune(); err == nil {
+    t.Error("Expected a second UnreadRune to fail")
+  }
+  var out strings.Builder
+  r.WriteTo(&out)
+  ExpectStringEquals(t, "rest", "ï\nthree\n", out.String())
+  out.Reset()
+  b.WriteTo(&out)
+  ExpectStringEquals(t, "contents", text, out.String())
+  var s scanner.Scanner
+  s.Init(b.NewReader())
+  if s.Scan(); s.TokenText() != "one" {
+    t.Error(fmt.Sprintf("Expected the first token to be 'one', but found %q", s.TokenText()))
+  }
+}
+
+func TestWriter(t *testing.T) {
+  b := NewBuffer(10)
+  b.InsertString("[]")
+  b.MoveCursorTo(1)
+  w := b.NewWriter()
+  fmt.Fprintf(w, "%v-%v", 1, 2)
+  w.WriteRune('é')
+  io.WriteString(w, "!")
+  ExpectBufferValue(t, b, "[1-2é!", "]")
+}
+
+func TestErrors(t *testing.T) {
+  b := NewBuffer(8)
+  b.InsertString("abc")
+  _, err := b.GetCharAt(5)
+  var pos_err *PositionError
+  if !errors.As(err, &pos_err) || pos_err.Pos != 5 || pos_err.Length != 3 {
+    t.Errorf("Expected a PositionError for 5 of 3, got %v", err)
+  }
+  if !errors.Is(err, PAST_END.Err()) || errors.Is(err, BEFORE_START.Err()) {
+    t.Errorf("Expected PAST_END, got %v", err)
+  }
+  if ResultCodeOf(err) != PAST_END || ResultCodeOf(nil) != SUCCEEDED {
+    t.Errorf("Wrong result codes for %v", err)
+  }
+  if SUCCEEDED.Err() != nil || ResultCodeOf(b.Redo()) != INVALID || INVALID.String() != "invalid" {
+    t.Error("Expected result codes to convert to and from errors")
+  }
+  if _, err := b.GetRange(-1, 2); !errors.Is(err, BEFORE_START.Err()) {
+    t.Errorf("Expected BEFORE_START, got %v", err)
+  }
+  if err.Error() != "buf: past the end of the buffer: position 5 in a buffer of length 3" {
+    t.Errorf("Unexpected message %q", err.Error())
+  }
+  missing := filepath.Join(os.TempDir(), "buf_test_missing_file")
+  _, err = NewFileBuffer(missing)
+  var path_err *fs.PathError
+  if !errors.Is(err, IO_ERROR.Err()) || !errors.As(err, &path_err) || path_err.Path != missing {
+    t.Errorf("Expected an IO_ERROR wrapping a PathError, got %v", err)
+  }
+  if !errors.Is(err, fs.ErrNotExist) || ResultCodeOf(err) != IO_ERROR {
+    t.Errorf("Expected the error to be fs.ErrNotExist, got %v", err)
+  }
+}
+
+func TestStepBeforeStart(t *testing.T) {
+  forEachBuffer(t, func(t *testing.T, b EditBuffer) {
+    b.InsertString("a\nb")
+    b.MoveCursorTo(0)
+    err := b.StepCursorBackward()
+    var pos_err *PositionError
+    if !errors.Is(err, BEFORE_START.Err()) || !errors.As(err, &pos_err) || pos_err.Pos != -1 {
+      t.Errorf("Expected stepping back from the start to be BEFORE_START, got %v", err)
+    }
+    ExpectBufferValue(t, b, "", "a\nb")
+  })
+}
+
+// Saving keeps the setuid, setgid and sticky bits, as well as the
+// permissions.
+func TestWriteKeepsMode(t *testing.T) {
+  if runtime.GOOS == "windows" {
+    t.Skip("no setgid or sticky bits")
+  }
+  filename := filepath.Join(t.TempDir(), "special")
+  ioutil.WriteFile(filename, []uint8("Hello world.\n"), 0644)
+  special := os.FileMode(0750) | os.ModeSetgid | os.ModeSticky
+  os.Chmod(filename, special)
+  f, _ := NewFileBuffer(filename)
+  f.InsertString("Again.\n")
+  if err := f.Write(); err != nil {
+    t.Fatal(fmt.Sprintf("Error writing file '%v', error was '%v'", filename, err))
+  }
+  if info, _ := os.Stat(filename); info.Mode()&savedModeBits != special {
+    t.Error(fmt.Sprintf("Expected mode %v, but found %v", special, info.Mode()))
+  }
+}
+
+func TestAtomicWrite(t *testing.T) {
+  dir := t.TempDir()
+  filename := filepath.Join(dir, "saved")
+  ioutil.WriteFile(filename, []uint8("Hello world.\n"), 0640)
+  os.Chmod(filename, 0640)
+  f, err := NewFileBuffer(filename)
+  if err != nil {
+    t.Fatal(fmt.Sprintf("Expected to be able to read file %v; error '%v'.", filename, err))
+  }
+  f.MoveCursorTo(0)
+  f.InsertString("Saved: ")
+  if err := f.Write(); err != nil {
+    t.Fatal(fmt.Sprintf("Error writing file '%v', error was '%v'", filename, err))
+  }
+  contents, _ := ioutil.ReadFile(filename)
+  ExpectStringEquals(t, "saved file", "Saved: Hello world.\n", string(contents))
+  backup, _ := ioutil.ReadFile(filename + ".bak")
+  ExpectStringEquals(t, "backup file", "Hello world.\n", string(backup))
+  if info, _ := os.Stat(filename); info.Mode().Perm() != 0640 {
+    t.Error(fmt.Sprintf("Expected mode 0640, but found %v", info.Mode().Perm()))
+  }
+  entries, _ := os.ReadDir(dir)
+  if len(entries) != 2 {
+    t.Error(fmt.Sprintf("Expected only the file and its backup, but found %v entries", len(entries)))
+  }
+  if f.IsDirty() {
+    t.Error("Expected the buffer to be clean after writing")
+  }
+
+  // Saving through a symbolic link replaces the file, not the link.
+  link := filepath.Join(dir, "link")
+  if os.Symlink(filename, link) == nil {
+    g, _ := NewFileBuffer(link)
+    g.MoveCursorTo(0)
+    g.InsertString("Linked: ")
+    g.Write()
+    if info, _ := os.Lstat(link); info.Mode()&os.ModeSymlink == 0 {
+      t.Error("Expected the link to still be a link after writing")
+    }
+    contents, _ = ioutil.ReadFile(filename)
+    ExpectStringEquals(t, "file saved through link", "Linked: Saved: Hello world.\n", string(contents))
+  }
+
+  f.filename = filepath.Join(dir, "missing", "saved")
+  f.InsertString("!")
+  err = f.Write()
+  var path_err *fs.PathError
+  if !errors.Is(err, IO_ERROR.Err()) || !errors.As(err, &path_err) {
+    t.Error(fmt.Sprintf("Expected an IO_ERROR wrapping a PathError, got %v", err))
+  }
+  if !f.IsDirty() {
+    t.Error("Expected the buffer to stay dirty after a failed write")
+  }
+}
+
+// Backups are copied rather than linked across file systems, and the
+// copy has to be as private as the file.
+func TestBackupCopy(t *testing.T) {
+  dir := t.TempDir()
+  from := filepath.Join(dir, "private")
+  to := filepath.Join(dir, "private.bak")
+  ioutil.WriteFile(from, []uint8("secret\n"), 0600)
+  ioutil.WriteFile(to, []uint8("old backup, which was readable\n"), 0644)
+  if err := copyFile(from, to); err != nil {
+    t.Fatal(fmt.Sprintf("Expected the copy to succeed, got %v", err))
+  }
+  contents, _ := ioutil.ReadFile(to)
+  ExpectStringEquals(t, "copied backup", "secret\n", string(contents))
+  if info, _ := os.Stat(to); info.Mode().Perm() != 0600 {
+    t.Error(fmt.Sprintf("Expected the copy to be private, like the file; got %v", info.Mode()))
+  }
+}
+
+func TestBackupPolicy(t *testing.T) {
+  dir := t.TempDir()
+  filename := filepath.Join(dir, "file")
+  ioutil.WriteFile(filename, []uint8("version 0\n"), 0644)
+  f, _ := NewFileBuffer(filename)
+  f.SetBackupPolicy(BackupPolicy{Mode: BACKUP_NUMBERED, Keep: 2})
+  for i := 1; i <= 3; i++ {
+    f.Clear()
+    f.InsertString(fmt.Sprintf("version %v\n", i))
+    if err := f.Write(); err != nil {
+      t.Fatal(fmt.Sprintf("Error writing file '%v', error was '%v'", filename, err))
+    }
+  }
+  backups, err := f.ListBackups()
+  if err != nil || len(backups) != 2 || backups[0].Number != 2 || backups[1].Number != 3 {
+    t.Fatal(fmt.Sprintf("Expected backups 2 and 3, but found %v (%v)", backups, err))
+  }
+  ExpectStringEquals(t, "backup name", filename+".~3~", backups[1].Path)
+  if err := f.RestoreBackup(backups[0]); err != nil {
+    t.Error(fmt.Sprintf("Error restoring backup: %v", err))
+  }
+  ExpectStringEquals(t, "restored buffer", "version 1\n", f.String())
+  if !f.IsDirty() {
+    t.Error("Expected a restored buffer to be dirty")
+  }
+  f.Undo()
+  ExpectStringEquals(t, "undone restore", "version 3\n", f.String())
+
+  // Backups are decoded like the file.
+  encoded := filepath.Join(dir, "encoded")
+  ioutil.WriteFile(encoded, []uint8{0xFF, 0xFE, 'o', 0, 'l', 0, 'd', 0, '\r', 0, '\n', 0}, 0644)
+  g, _ := NewFileBuffer(encoded)
+  g.Clear()
+  g.InsertString("new\n")
+  g.Write()
+  backups, _ = g.ListBackups()
+  if len(backups) != 1 || g.RestoreBackup(backups[0]) != nil {
+    t.Fatal(fmt.Sprintf("Expected to restore a single backup, but found %v", backups))
+  }
+  ExpectStringEquals(t, "restored UTF-16 buffer", "old\n", g.String())
+  if err := g.Write(); err != nil {
+    t.Error(fmt.Sprintf("Error writing restored file, error was '%v'", err))
+  }
+  contents, _ := ioutil.ReadFile(encoded)
+  if !bytes.Equal(contents, []uint8{0xFF, 0xFE, 'o', 0, 'l', 0, 'd', 0, '\r', 0, '\n', 0}) {
+    t.Error(fmt.Sprintf("Expected the restored file to be written as UTF-16, but found %v", contents))
+  }
+
+  backup_dir := filepath.Join(dir, "backups")
+  f.SetBackupPolicy(BackupPolicy{Mode: BACKUP_DIRECTORY, Dir: backup_dir})
+  f.InsertString("more\n")
+  f.Write()
+  backups, _ = f.ListBackups()
+  abs, _ := filepath.Abs(filename)
+  mangled := strings.ReplaceAll(filepath.ToSlash(abs), "/", "!")
+  if len(backups) != 1 || backups[0].Path != filepath.Join(backup_dir, mangled+".~1~") {
+    t.Fatal(fmt.Sprintf("Expected one backup in %v, but found %v", backup_dir, backups))
+  }
+  contents, _ = ioutil.ReadFile(backups[0].Path)
+  ExpectStringEquals(t, "directory backup", "version 3\n", string(contents))
+
+  f.SetBackupPolicy(BackupPolicy{Mode: BACKUP_NONE})
+  f.InsertString("last\n")
+  f.Write()
+  if backups, _ = f.ListBackups(); len(backups) != 0 {
+    t.Error(fmt.Sprintf("Expected no backups, but found %v", backups))
+  }
+  if _, err := os.Stat(filename + ".bak"); err == nil {
+    t.Error("Expected no single backup to be made")
+  }
+}
+
+func TestLineEndings(t *testing.T) {
+  dir := t.TempDir()
+  filename := filepath.Join(dir, "dos")
+  ioutil.WriteFile(filename, []uint8("first\r\nsecond\r\nthird\r\n"), 0644)
+  f, _ := NewFileBuffer(filename)
+  if f.LineEnding() != LINE_ENDING_CRLF || f.HasMixedLineEndings() {
+    t.Error(fmt.Sprintf("Expected unmixed CRLF line endings, but found %v", f.LineEnding()))
+  }
+  ExpectBufferValue(t, f, "first\nsecond\nthird\n", "")
+  if line, col, _ := f.GetCoordinates(12); line != 2 || col != 6 {
+    t.Error(fmt.Sprintf("Expected line 2 column 6, but found %v/%v", line, col))
+  }
+  f.MoveToLine(2)
+  f.InsertString("new\n")
+  f.Write()
+  contents, _ := ioutil.ReadFile(filename)
+  ExpectStringEquals(t, "written file", "first\r\nnew\r\nsecond\r\nthird\r\n", string(contents))
+
+  f.SetLineEnding(LINE_ENDING_CR)
+  if !f.IsDirty() {
+    t.Error("Expected changing the line ending to make the buffer dirty")
+  }
+  f.Write()
+  contents, _ = ioutil.ReadFile(filename)
+  ExpectStringEquals(t, "converted file", "first\rnew\rsecond\rthird\r", string(contents))
+
+  ioutil.WriteFile(filename, []uint8("one\r\ntwo\nthree\r\nfour\r"), 0644)
+  g, _ := NewFileBuffer(filename)
+  if g.LineEnding() != LINE_ENDING_CRLF || !g.HasMixedLineEndings() {
+    t.Error(fmt.Sprintf("Expected mixed CRLF line endings, but found %v", g.LineEnding()))
+  }
+  // A mixed file is left alone until it's converted.
+  ExpectStringEquals(t, "mixed buffer", "one\r\ntwo\nthree\r\nfour\r", g.String())
+  g.MoveCursorTo(0)
+  g.InsertString("zero\n")
+  g.Write()
+  contents, _ = ioutil.ReadFile(filename)
+  ExpectStringEquals(t, "mixed file", "zero\none\r\ntwo\nthree\r\nfour\r", string(contents))
+  g.SetLineEnding(LINE_ENDING_CRLF)
+  ExpectStringEquals(t, "converted buffer", "zero\none\ntwo\nthree\nfour\n", g.String())
+  if g.LineCount() != 6 || g.HasMixedLineEndings() {
+    t.Error(fmt.Sprintf("Expected 6 unmixed lines, but found %v", g.LineCount()))
+  }
+  g.Write()
+  contents, _ = ioutil.ReadFile(filename)
+  ExpectStringEquals(t, "converted file", "zero\r\none\r\ntwo\r\nthree\r\nfour\r\n", string(contents))
+
+  // Carriage returns that aren't line endings are left alone.
+  ioutil.WriteFile(filename, []uint8("x := \"a\rb\"\nline2\n"), 0644)
+  h, _ := NewFileBuffer(filename)
+  h.MoveCursorTo(h.Length())
+  h.InsertString("line3\n")
+  h.Write()
+  contents, _ = ioutil.ReadFile(filename)
+  ExpectStringEquals(t, "file with a carriage return", "x := \"a\rb\"\nline2\nline3\n", string(contents))
+  ExpectStringEquals(t, "converted text", "a\r\nb\r\n",
+    string(ConvertLineEndings([]uint8("a\rb\n"), LINE_ENDING_CRLF)))
+}
+
+func TestEncodings(t *testing.T) {
+  dir := t.TempDir()
+  filename := filepath.Join(dir, "resource.rc")
+  ioutil.WriteFile(filename, []uint8{0xFF, 0xFE, 'h', 0, 0xE9, 0, '\r', 0, '\n', 0, 0x3D, 0xD8, 0x00, 0xDE}, 0644)
+  f, err := NewFileBuffer(filename)
+  if err != nil {
+    t.Fatal(fmt.Sprintf("Expected to be able to read file %v; error '%v'.", filename, err))
+  }
+  if encoding, bom := f.Encoding(); encoding != ENCODING_UTF16LE || !bom {
+    t.Error(fmt.Sprintf("Expected UTF-16LE with a BOM, but found %v/%v", encoding, bom))
+  }
+  ExpectStringEquals(t, "decoded buffer", "hé\n😀", f.String())
+  f.InsertString("!")
+  f.Write()
+  contents, _ := ioutil.ReadFile(filename)
+  expected := []uint8{0xFF, 0xFE, 'h', 0, 0xE9, 0, '\r', 0, '\n', 0, 0x3D, 0xD8, 0x00, 0xDE, '!', 0}
+  if !bytes.Equal(contents, expected) {
+    t.Error(fmt.Sprintf("Expected UTF-16 file %v, but found %v", expected, contents))
+  }
+
+  filename = filepath.Join(dir, "legacy.c")
+  ioutil.WriteFile(filename, []uint8("caf\xe9\n"), 0644)
+  g, _ := NewFileBuffer(filename)
+  if encoding, bom := g.Encoding(); encoding != ENCODING_LATIN1 || bom {
+    t.Error(fmt.Sprintf("Expected Latin-1, but found %v/%v", encoding, bom))
+  }
+  ExpectStringEquals(t, "decoded buffer", "café\n", g.String())
+  g.MoveCursorTo(0)
+  g.InsertString("€ ")
+  err = g.Write()
+  var enc_err *EncodingError
+  if !errors.Is(err, ENCODING_ERROR.Err()) || !errors.As(err, &enc_err) || enc_err.Pos != 0 || enc_err.Rune != '€' {
+    t.Error(fmt.Sprintf("Expected an EncodingError for the euro sign, got %v", err))
+  }
+  contents, _ = ioutil.ReadFile(filename)
+  ExpectStringEquals(t, "unwritten file", "caf\xe9\n", string(contents))
+  g.MoveCursorTo(0)
+  g.Cut(len("€ "))
+  g.SetEncoding(ENCODING_UTF8, true)
+  if err := g.Write(); err != nil {
+    t.Error(fmt.Sprintf("Error writing file '%v', error was '%v'", filename, err))
+  }
+  contents, _ = ioutil.ReadFile(filename)
+  ExpectStringEquals(t, "converted file", "\xef\xbb\xbfcafé\n", string(contents))
+
+  if encoding, bom := DetectEncoding([]uint8{0, 'a', 0, 'b', 0, 'c', 0, '\n'}); encoding != ENCODING_UTF16BE || bom {
+    t.Error(fmt.Sprintf("Expected UTF-16BE without a BOM, but found %v/%v", encoding, bom))
+  }
+  for _, text := range []string{"Q\n", "}\n", "é", "ab\x00c"} {
+    if encoding, _ := DetectEncoding([]uint8(text)); encoding == ENCODING_UTF16LE || encoding == ENCODING_UTF16BE {
+      t.Error(fmt.Sprintf("Expected %q not to be guessed as %v", text, encoding))
+    }
+  }
+  _, err = DecodeText([]uint8{0xFF, 0xFE, 'a', 0, 0x3D, 0xD8}, ENCODING_UTF16LE, true)
+  if !errors.As(err, &enc_err) || !enc_err.Decoding || enc_err.Pos != 4 {
+    t.Error(fmt.Sprintf("Expected an unpaired surrogate at 4 to be a decoding error, got %v", err))
+  }
+  ExpectStringEquals(t, "decoding error", "buf: encoding error: undecodable UTF-16LE bytes at offset 4", err.Error())
+}
+
+func TestExternalChange(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "shared")
+  ioutil.WriteFile(filename, []uint8("one\ntwo\nthree\n"), 0644)
+  f, _ := NewFileBuffer(filename)
+  if changed, err := f.ChangedOnDisk(); changed || err != nil {
+    t.Error(fmt.Sprintf("Expected the file to be unchanged, got %v/%v", changed, err))
+  }
+  later := time.Now().Add(time.Minute)
+  os.Chtimes(filename, later, later)
+  if changed, _ := f.ChangedOnDisk(); changed {
+    t.Error("Expected touching the file not to change it")
+  }
+  ioutil.WriteFile(filename, []uint8("one\ntwo\nthree\nfour\n"), 0644)
+  if changed, _ := f.ChangedOnDisk(); !changed {
+    t.Error("Expected the file to have changed")
+  }
+  f.InsertString("local\n")
+  if err := f.Write(); !errors.Is(err, FILE_CHANGED.Err()) {
+    t.Error(fmt.Sprintf("Expected FILE_CHANGED, got %v", err))
+  }
+  contents, _ := ioutil.ReadFile(filename)
+  ExpectStringEquals(t, "unwritten file", "one\ntwo\nthree\nfour\n", string(contents))
+  if err := f.ForceWrite(); err != nil {
+    t.Error(fmt.Sprintf("Error writing file '%v', error was '%v'", filename, err))
+  }
+  contents, _ = ioutil.ReadFile(filename)
+  ExpectStringEquals(t, "forced file", "one\ntwo\nthree\nlocal\n", string(contents))
+  if changed, _ := f.ChangedOnDisk(); changed {
+    t.Error("Expected the file to be unchanged after writing it")
+  }
+}
+
+func TestReload(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "reloaded")
+  ioutil.WriteFile(filename, []uint8("alpha\nbeta\ngamma\ndelta\n"), 0644)
+  f, _ := NewFileBuffer(filename)
+  f.SetMark("delta", 17)
+  f.MoveCursorTo(13)
+  var kinds []ChangeKind
+  f.Subscribe(ChangeFunc(func(events []ChangeEvent) {
+    for _, e := range events {
+      kinds = append(kinds, e.Kind)
+    }
+  }))
+  ioutil.WriteFile(filename, []uint8("intro\nalpha\nbeta\ngamma\ndelta\n"), 0644)
+  if conflicts, err := f.Reload(); conflicts != 0 || err != nil {
+    t.Fatal(fmt.Sprintf("Expected a clean reload, got %v/%v", conflicts, err))
+  }
+  ExpectBufferValue(t, f, "intro\nalpha\nbeta\nga", "mma\ndelta\n")
+  if pos, _ := f.GetMark("delta"); pos != 23 {
+    t.Error(fmt.Sprintf("Expected the mark to move to 23, but found %v", pos))
+  }
+  if f.IsDirty() || len(kinds) != 1 || kinds[0] != RELOAD_CHANGE {
+    t.Error(fmt.Sprintf("Expected one reload change and a clean buffer, got %v/%v", kinds, f.IsDirty()))
+  }
+  f.Undo()
+  ExpectStringEquals(t, "undone reload", "alpha\nbeta\ngamma\ndelta\n", f.String())
+}
+
+func TestReloadMerge(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "merged")
+  ioutil.WriteFile(filename, []uint8("alpha\nbeta\ngamma\ndelta\n"), 0644)
+  f, _ := NewFileBuffer(filename)
+  f.MoveToLine(2)
+  f.Cut(4)
+  f.InsertString("BETA")
+  ioutil.WriteFile(filename, []uint8("alpha\nbeta\ngamma\nDELTA\n"), 0644)
+  if conflicts, err := f.Reload(); conflicts != 0 || err != nil {
+    t.Fatal(fmt.Sprintf("Expected a clean merge, got %v/%v", conflicts, err))
+  }
+  ExpectStringEquals(t, "merged buffer", "alpha\nBETA\ngamma\nDELTA\n", f.String())
+  if !f.IsDirty() {
+    t.Error("Expected the merged buffer to be dirty")
+  }
+  if err := f.Write(); err != nil {
+    t.Error(fmt.Sprintf("Error writing file '%v', error was '%v'", filename, err))
+  }
+
+  f.MoveToLine(3)
+  f.InsertString("mine ")
+  ioutil.WriteFile(filename, []uint8("alpha\nBETA\ntheirs gamma\nDELTA\n"), 0644)
+  if conflicts, _ := f.Reload(); conflicts != 1 {
+    t.Error(fmt.Sprintf("Expected 1 conflict, but found %v", conflicts))
+  }
+  ExpectStringEquals(t, "conflicted buffer", "alpha\nBETA\n<<<<<<< buffer\nmine gamma\n=======\n"+
+    "theirs gamma\n>>>>>>> "+filename+"\nDELTA\n", f.String())
+}
+
+func TestDiffLines(t *testing.T) {
+  r := rand.New(rand.NewSource(25))
+  for i := 0; i < 200; i++ {
+    a := make([]string, r.Intn(20))
+    for j := range a {
+      a[j] = string(rune('a' + r.Intn(4)))
+    }
+    b := make([]string, r.Intn(20))
+    for j := range b {
+      b[j] = string(rune('a' + r.Intn(4)))
+    }
+    var patched []string
+    pos := 0
+    for _, h := range diffLines(a, b) {
+      patched = append(patched, a[pos:h.a_start]...)
+      patched = append(patched, b[h.b_start:h.b_end]...)
+      pos = h.a_end
+    }
+    patched = append(patched, a[pos:]...)
+    if strings.Join(patched, "") != strings.Join(b, "") {
+      t.Fatal(fmt.Sprintf("Patching %v to %v produced %v", a, b, patched))
+    }
+  }
+}
+
+//
+// Benchmarks
+//
+
+func benchmarkBuffer() *GapBuffer {
+  b := NewBuffer(1 << 20)
+  line := "the quick brown fox jumps over the lazy dog\n"
+  for b.Length() < 1<<20 {
+    b.InsertString(line)
+  }
+  return b
+}
+
+func BenchmarkMoveCursor(bench *testing.B) {
+  b := benchmarkBuffer()
+  bench.ResetTimer()
+  for i := 0; i < bench.N; i++ {
+    b.MoveCursorTo(0)
+    b.MoveCursorTo(b.Length())
+  }
+}
+
+func BenchmarkInsertAfterJump(bench *testing.B) {
+  b := benchmarkBuffer()
+  bench.ResetTimer()
+  for i := 0; i < bench.N; i++ {
+    b.MoveCursorTo((i * 7919) % b.Length())
+    b.InsertChar('x')
+  }
+}
+
+func BenchmarkBytes(bench *testing.B) {
+  b := benchmarkBuffer()
+  b.MoveCursorTo(b.Length() / 2)
+  bench.ResetTimer()
+  for i := 0; i < bench.N; i++ {
+    b.Bytes()
+  }
+}
+
+func BenchmarkGetRange(bench *testing.B) {
+  b := benchmarkBuffer()
+  b.MoveCursorTo(b.Length() / 2)
+  bench.ResetTimer()
+  for i := 0; i < bench.N; i++ {
+    b.GetRange(b.Length()/2-4096, b.Length()/2+4096)
+  }
+}
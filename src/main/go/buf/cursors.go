@@ -0,0 +1,200 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: cursors.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Multiple cursors.
+//
+// A buffer normally has a single cursor, at the gap. Adding a cursor
+// switches the buffer into multiple-cursor mode: the existing cursor
+// becomes the primary cursor, and the insert, cut and relative motion
+// methods act at every cursor at once. Each cursor is a selection;
+// its point - where text is inserted, and where motion starts - is
+// the tail of the selection. Since the cursors are made of marks,
+// an edit at one cursor automatically moves all the others. An empty
+// cursor is a point, with right gravity at both ends, so that like
+// the gap it ends up after text inserted at it - by undo and redo, or
+// by an edit at the gap - instead of growing to select that text.
+//
+// The edits made by one call are recorded as a single undo group.
+// Methods that edit at a specific position, like InsertStringAt or the
+// selection operations, only ever act at the gap; so do the edits
+// replayed by undo and redo. MoveCursorTo only moves the gap, too:
+// the cursors stay where they are, and the next edit happens at them.
+// To move to a position and edit there alone, call ClearCursors first.
+
+package buf
+
+import (
+  "sort"
+)
+
+// Add an empty cursor at pos.
+func (self *GapBuffer) AddCursor(pos int) error {
+  return self.AddSelectionCursor(pos, pos)
+}
+
+// Add a cursor that selects the text from front to tail. Cursors that
+// overlap an existing cursor are merged with it.
+func (self *GapBuffer) AddSelectionCursor(front int, tail int) error {
+  if err := self.checkRange(front, tail); err != nil {
+    return err
+  }
+  if len(self.cursors) == 0 {
+    pos := self.GetCurrentPosition()
+    self.cursors = append(self.cursors, self.newCursor(pos, pos))
+  }
+  self.cursors = append(self.cursors, self.newCursor(front, tail))
+  self.mergeCursors()
+  return nil
+}
+
+func (self *GapBuffer) newCursor(front int, tail int) *Selection {
+  c := self.newSelection(front, tail)
+  setCursorGravity(c)
+  return c
+}
+
+// Give an empty cursor right gravity at both ends, and a cursor that
+// selects text the gravity of a selection.
+func setCursorGravity(c *Selection) {
+  if c.IsEmpty() {
+    c.front.gravity = RIGHT_GRAVITY
+  } else {
+    c.front.gravity = LEFT_GRAVITY
+  }
+}
+
+// Drop all of the cursors except the primary, and go back to editing
+// at a single cursor.
+func (self *GapBuffer) ClearCursors() {
+  if len(self.cursors) == 0 {
+    return
+  }
+  self.MoveCursorTo(self.cursors[0].Tail())
+  for _, c := range self.cursors {
+    self.releaseSelection(c)
+  }
+  self.cursors = nil
+}
+
+// Get the cursors, in buffer order. In single-cursor mode, this is an
+// empty list.
+func (self *GapBuffer) Cursors() []*Selection {
+  result := make([]*Selection, len(self.cursors))
+  copy(result, self.cursors)
+  sort.Sort(selectionsByPosition(result))
+  return result
+}
+
+// Get the primary cursor, or nil in single-cursor mode.
+func (self *GapBuffer) PrimaryCursor() *Selection {
+  if len(self.cursors) == 0 {
+    return nil
+  }
+  return self.cursors[0]
+}
+
+func (self *GapBuffer) HasMultipleCursors() bool {
+  return len(self.cursors) > 1
+}
+
+// Should an edit method act at all of the cursors?
+func (self *GapBuffer) atCursors() bool {
+  return len(self.cursors) > 0 && !self.undoing
+}
+
+// Apply an edit at the point of every cursor, as a single undo step.
+// When the edit is done, the cursor is collapsed to wherever it left
+// the gap. The buffer's cursor ends up at the primary cursor.
+func (self *GapBuffer) eachCursor(edit func(c *Selection)) {
+  self.BeginUndoGroup()
+  for _, c := range self.cursors {
+    self.MoveCursorTo(c.Tail())
+    edit(c)
+    c.front.pos = self.GetCurrentPosition()
+    c.tail.pos = c.front.pos
+    setCursorGravity(c)
+  }
+  self.EndUndoGroup()
+  self.MoveCursorTo(self.cursors[0].Tail())
+  self.mergeCursors()
+}
+
+// Delete the text selected by a cursor, leaving the gap where it was.
+func (self *GapBuffer) cutCursorSelection(c *Selection) []uint8 {
+  self.MoveCursorTo(c.Front())
+  return self.cut(c.Length())
+}
+
+// Merge any cursors that overlap, or that are at the same position.
+// If the primary cursor is merged, the merged cursor becomes the
+// primary. If only one cursor is left, the buffer goes back to
+// single-cursor mode.
+func (self *GapBuffer) mergeCursors() {
+  sorted := self.Cursors()
+  merged := make(map[*Selection]bool)
+  last := sorted[0]
+  for _, c := range sorted[1:] {
+    if c.Front() < last.Tail() || c.Front() == last.Front() || (c.Front() == last.Tail() && (c.IsEmpty() || last.IsEmpty())) {
+      if c.Tail() > last.Tail() {
+        last.tail.pos = c.Tail()
+      }
+      if c == self.cursors[0] {
+        // Keep the primary cursor, with the merged range.
+        c.front.pos = last.Front()
+        c.tail.pos = last.Tail()
+        merged[last] = true
+        last = c
+      } else {
+        merged[c] = true
+      }
+    } else {
+      last = c
+    }
+  }
+  kept := self.cursors[:0]
+  for _, c := range self.cursors {
+    if merged[c] {
+      self.releaseSelection(c)
+    } else {
+      setCursorGravity(c)
+      kept = append(kept, c)
+    }
+  }
+  self.cursors = kept
+  if len(self.cursors) == 1 {
+    self.ClearCursors()
+  }
+}
+
+func (self *GapBuffer) releaseSelection(s *Selection) {
+  self.ReleaseMark(s.front)
+  self.ReleaseMark(s.tail)
+}
+
+type selectionsByPosition []*Selection
+
+func (self selectionsByPosition) Len() int { return len(self) }
+
+func (self selectionsByPosition) Less(i, j int) bool {
+  if self[i].Front() != self[j].Front() {
+    return self[i].Front() < self[j].Front()
+  }
+  return self[i].Tail() < self[j].Tail()
+}
+
+func (self selectionsByPosition) Swap(i, j int) {
+  self[i], self[j] = self[j], self[i]
+}
@@ -21,126 +21,117 @@ package buf
 /* Insert a char at the cursor.
  */
 func (self *GapBuffer) InsertChar(c uint8) {
-  self.dirty = true
-  self.primInsertChar(c, !self.undoing)
+  self.InsertChars([]uint8{c})
 }
 
-func (self *GapBuffer) primInsertChar(c uint8, record_undo bool) {
-  if record_undo {
-    undo := RecordInsert(self, self.PreLength(), 1)
-    self.pushUndo(undo)
-  }
-  self.PushPre(c)
-  if c == '\n' {
-    self.line++
-    self.column = 0
-  } else {
-    self.column++
+// Insert chars at the cursor. With multiple cursors, the chars are
+// inserted at each cursor, replacing any text that it selects.
+func (self *GapBuffer) InsertChars(cs []uint8) {
+  if self.atCursors() {
+    self.eachCursor(func(c *Selection) {
+      self.cutCursorSelection(c)
+      self.insertChars(cs)
+    })
+    return
   }
+  self.insertChars(cs)
 }
 
-// This may look inefficient - but since we need to walk through the string looking for
-// newlines in order to keep the line and column markers correct, it's actually about 
-// as good as you can really get. 
-// Eventually, we can use some caching/memoization to improve it.
-func (self *GapBuffer) InsertChars(cs []uint8) {
-  self.dirty = true
-  pos := self.PreLength()
-  for i := range cs {
-    self.primInsertChar(cs[i], false)
+// Insert chars at the gap. Inserting nothing isn't an edit, so it
+// leaves the undo history alone.
+func (self *GapBuffer) insertChars(cs []uint8) {
+  if len(cs) == 0 {
+    return
   }
+  self.dirty = true
+  pos, line := self.PreLength(), self.line
   if !self.undoing {
-    undo := RecordInsert(self, pos, len(cs))
+    undo := RecordInsert(self, pos, cs)
     self.pushUndo(undo)
   }
+  self.insertAtGap(cs)
+  self.newVersion(pos, nil, cs)
+  self.changed(pos, line, nil, cs)
 }
 
 func (self *GapBuffer) InsertString(s string) {
-  self.dirty = true
-  pos := self.PreLength()
-  for i := range (s) {
-    self.primInsertChar(s[i], false)
-  }
-  if !self.undoing {
-    undo := RecordInsert(self, pos, len(s))
-    self.pushUndo(undo)
+  self.InsertChars([]uint8(s))
+}
+
+func (self *GapBuffer) StepCursorForward() error {
+  if self.atCursors() {
+    self.MoveCursorBy(1)
+    return nil
   }
+  return self.stepCursorForward()
 }
 
-func (self *GapBuffer) StepCursorForward() ResultCode {
+func (self *GapBuffer) stepCursorForward() error {
   if self.PostLength() > 0 {
     c := self.PopPost()
     self.PushPre(c)
     if c == '\n' {
       self.line++
       self.column = 0
+    } else {
+      self.column++
     }
   } else if self.PostLength() == 0 {
-    return PAST_END
+    return checkPosition(self.Length()+1, self.Length())
   }
-  return SUCCEEDED
+  return nil
 }
 
+// Move the cursor to pos. With multiple cursors, this only moves the
+// gap; see cursors.go.
 func (self *GapBuffer) MoveCursorTo(pos int) {
-  if self.PreLength() > pos {
-    dist := self.PreLength() - pos
-    self.MoveCursorBy(- dist)
-  } else {
-    dist := pos - self.PreLength()
-    self.MoveCursorBy(dist)
+  if pos < 0 {
+    pos = 0
+  } else if pos > self.Length() {
+    pos = self.Length()
   }
+  self.moveGap(pos)
+  self.updateLineAndColumn()
 }
 
+// Move the cursor by a distance. With multiple cursors, every cursor
+// is moved, and the cursors that run into each other are merged.
 func (self *GapBuffer) MoveCursorBy(dist int) {
-  if dist < 0 {
-    dist = -dist
-    for i := int(0); i < dist; i++ {
-		  self.StepCursorBackward()
-    }
-  } else {
-    for i := int(0); i < dist; i++ {
-      self.StepCursorForward()
-    }
+  if self.atCursors() {
+    self.eachCursor(func(c *Selection) {
+      self.MoveCursorTo(c.Tail() + dist)
+    })
+    return
   }
+  self.MoveCursorTo(self.PreLength() + dist)
 }
 
-func (self *GapBuffer) StepCursorBackward() ResultCode {
-  if self.PreLength() > 0 {
-    c := self.PopPre()
-    self.PushPost(c)
-    if c == '\n' {
-      self.line--
-      i := 1
-      for i < self.PreLength() && self.prechars[self.PreLength()-i] != '\n' {
-        i++
-      }
-      self.column = i - 1
-    } else {
-      self.column--
-      if self.column < 0 {
-        return BEFORE_START
-      }
-    }
+func (self *GapBuffer) StepCursorBackward() error {
+  if self.atCursors() {
+    self.MoveCursorBy(-1)
+    return nil
   }
-  return SUCCEEDED
-}
-
-func (self *GapBuffer) countCurrentColumn() int {
-  pos := self.PreLength() - 1
-  column := int(0)
-  // Count the number of characters going back until
-  // you hit either a newline, or the beginning of a file.
-  for self.prechars[pos] != '\n' && pos > 0 {
-    column++
-    pos--
+  if self.PreLength() == 0 {
+    return checkPosition(-1, self.Length())
   }
-  return column
+  c := self.PopPre()
+  self.PushPost(c)
+  if c == '\n' {
+    self.line--
+    self.column = self.PreLength() - self.lineStart(self.PreLength())
+  } else {
+    self.column--
+  }
+  return nil
 }
 
 func (self *GapBuffer) MoveToLine(linenum int) {
-  self.MoveCursorTo(0)
-  for self.line < linenum && self.PostLength() > 0 {
-    self.StepCursorForward()
+  if linenum > self.LineCount() {
+    self.MoveCursorTo(self.Length())
+  } else if linenum <= 1 {
+    self.MoveCursorTo(0)
+  } else {
+    self.MoveCursorTo(self.newlinePosition(linenum-2) + 1)
   }
 }
 
@@ -149,144 +140,102 @@ func (self *GapBuffer) MoveToColumn(col int) {
     dist := col - self.column
     for i := int(0); i < dist; i++ {
       if self.PeekPost() != '\n' {
-        self.StepCursorForward()
+        self.stepCursorForward()
       }
     }
   } else {
     dist := self.column - col
-    self.MoveCursorBy(- int(dist))
+    self.MoveCursorTo(self.PreLength() - dist)
   }
 }
 
+// Cut dist characters after the cursor, or before it if dist is
+// negative. With multiple cursors, a cursor that selects text cuts its
+// selection, and an empty cursor cuts dist characters; the result is
+// the text cut at the primary cursor.
 func (self *GapBuffer) Cut(dist int) (cutbuf []uint8) {
-  self.dirty = true
+  if self.atCursors() {
+    self.eachCursor(func(c *Selection) {
+      var text []uint8
+      if c.IsEmpty() {
+        text = self.cut(dist)
+      } else {
+        text = self.cutCursorSelection(c)
+      }
+      if c == self.cursors[0] {
+        cutbuf = text
+      }
+    })
+    return
+  }
+  return self.cut(dist)
+}
+
+// Cut text at the gap. Cutting nothing, at either end of the buffer,
+// isn't an edit, so it leaves the undo history alone.
+func (self *GapBuffer) cut(dist int) (cutbuf []uint8) {
   if dist >= 0 {
     realdist := int(dist)
     if realdist > self.PostLength() {
       realdist = self.PostLength()
     }
-    cutbuf = make([]uint8, realdist)
-    for i := int(0); i < realdist; i++ {
-      c := self.PopPost()
-      cutbuf[i] = c
+    if realdist == 0 {
+      return []uint8{}
     }
+    self.dirty = true
+    cutbuf = make([]uint8, realdist)
+    copy(cutbuf, self.data[self.gap_end:])
+    self.deleteAfterGap(realdist)
     if !self.undoing {
       undo := RecordDelete(self, self.PreLength(), cutbuf)
       self.pushUndo(undo)
     }
+    self.newVersion(self.PreLength(), cutbuf, nil)
+    self.changed(self.PreLength(), self.line, cutbuf, nil)
   } else {
     realdist := -dist
     if realdist > self.PreLength() {
       realdist = self.PreLength()
     }
+    if realdist == 0 {
+      return []uint8{}
+    }
+    self.dirty = true
     pos := self.PreLength() - realdist
     cutbuf = make([]uint8, realdist)
-    for i := int(0); i < realdist; i++ {
-      cutbuf[realdist-i-1] = self.PopPre()
-    }
+    copy(cutbuf, self.data[pos:self.gap_start])
+    self.deleteBeforeGap(realdist)
     if !self.undoing {
       undo := RecordDelete(self, pos, cutbuf)
       self.pushUndo(undo)
     }
+    self.newVersion(pos, cutbuf, nil)
+    self.changed(pos, self.line, cutbuf, nil)
   }
   return
 }
 
 func (self *GapBuffer) Copy(dist int) (copybuf []uint8) {
-  pos := self.PreLength()
   if dist >= 0 {
     realdist := dist
     if realdist > self.PostLength() {
       realdist = self.PostLength()
     }
     copybuf = make([]uint8, realdist)
-    for i := int(0); i < realdist; i++ {
-      c := self.PopPost()
-      if c == 0 {
-        return
-      }
-      copybuf[i] = c
-      self.PushPre(c)
-    }
+    copy(copybuf, self.data[self.gap_end:])
   } else {
     realdist := -dist
     if realdist > self.PreLength() {
       realdist = self.PreLength()
     }
     copybuf = make([]uint8, realdist)
-    for i := int(0); i < realdist; i++ {
-      c := self.PopPre()
-      copybuf[realdist-i-1] = c
-      self.PushPost(c)
-    }
+    copy(copybuf, self.data[self.gap_start-realdist:self.gap_start])
   }
-  self.MoveCursorTo(pos)
   return
 }
 
-func (self *GapBuffer) Undo() ResultCode {
-  self.undoing = true
-  undo, s := self.undo_stack[len(self.undo_stack)-1], self.undo_stack[:len(self.undo_stack)-1]
-  self.undo_stack = s
-  undo.Undo()
-  self.undoing = false
-  return SUCCEEDED
-}
-
-func (self *GapBuffer) GetCurrentPosition() int { return len(self.prechars) }
+func (self *GapBuffer) GetCurrentPosition() int { return self.gap_start }
 
 func (self *GapBuffer) GetCurrentLine() int { return self.line }
 
 func (self *GapBuffer) GetCurrentColumn() int { return self.column }
-
-func RecordInsert(b *GapBuffer, start int, length int) (result *InsertOperation) {
-  result = &InsertOperation{b, start, length}
-  return
-}
-
-func RecordDelete(b *GapBuffer, pos int, chars []uint8) (result *DeleteOperation) {
-  result = &DeleteOperation{b, pos, chars}
-  return
-}
-
-func (self *InsertOperation) GetBuffer() EditBuffer {
-  return self.buf
-}
-
-func (self *InsertOperation) Undo() {
-  self.buf.MoveCursorTo(self.start)
-  _ = self.buf.Cut(int(self.length))
-}
-
-func (self *DeleteOperation) GetBuffer() EditBuffer {
-  return self.buf
-}
-
-func (self *DeleteOperation) Undo() {
-  self.buf.MoveCursorTo(self.position)
-  self.buf.InsertChars(self.chars)
-}
-
-//
-// Undo-record types
-//
-
-
-// A basic insert operation
-type InsertOperation struct {
-  buf    *GapBuffer
-  start  int
-  length int
-}
-
-
-// A cut operation.
-type DeleteOperation struct {
-  buf      *GapBuffer
-  position int
-  chars    []uint8
-}
-
-func (self *GapBuffer) pushUndo(u UndoOperation) {
-  self.undo_stack = append(self.undo_stack, u)
-}
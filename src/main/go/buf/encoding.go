@@ -0,0 +1,234 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: encoding.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Character encodings.
+//
+// Buffers hold UTF-8. A file in another encoding is decoded when it's
+// read, and encoded again when it's written. The encoding is taken
+// from a byte order mark, if the file starts with one. Otherwise, a
+// file is UTF-16 if it looks like it (mostly ASCII, so every other
+// byte is zero) and decodes cleanly; UTF-8 if it's valid UTF-8; and
+// Latin-1 if it's anything else. Every byte is a Latin-1 character,
+// so a file that's neither UTF-16 nor UTF-8 is always read, and is
+// written back exactly as it was unless it's edited.
+//
+// Text that can't be represented in the file's encoding is an
+// *EncodingError, and is never written; nor is a file with a byte
+// order mark whose contents don't decode.
+
+package buf
+
+import (
+  "bytes"
+  "fmt"
+  "unicode/utf16"
+  "unicode/utf8"
+)
+
+type Encoding int
+
+const (
+  ENCODING_UTF8 Encoding = iota
+  ENCODING_UTF16LE
+  ENCODING_UTF16BE
+  ENCODING_LATIN1
+)
+
+var encodingNames = []string{"UTF-8", "UTF-16LE", "UTF-16BE", "ISO-8859-1"}
+
+var byteOrderMarks = [][]uint8{{0xEF, 0xBB, 0xBF}, {0xFF, 0xFE}, {0xFE, 0xFF}, nil}
+
+func (self Encoding) String() string { return encodingNames[self] }
+
+// A character that can't be encoded, or a sequence of bytes that
+// can't be decoded. Pos is the position of the character in the
+// buffer, or of the bytes in the file, counting its byte order mark.
+// When Decoding is set, Rune is the code unit that couldn't be
+// decoded.
+type EncodingError struct {
+  Encoding Encoding
+  Pos      int
+  Rune     rune
+  Decoding bool
+}
+
+func (self *EncodingError) Error() string {
+  if self.Decoding {
+    return fmt.Sprintf("%v: undecodable %v bytes at offset %d", ENCODING_ERROR.Err(), self.Encoding, self.Pos)
+  }
+  return fmt.Sprintf("%v: %U at %d can't be represented in %v", ENCODING_ERROR.Err(), self.Rune, self.Pos, self.Encoding)
+}
+
+func (self *EncodingError) Unwrap() error { return ENCODING_ERROR.Err() }
+
+// Find the encoding of the contents of a file, and whether they start
+// with a byte order mark.
+func DetectEncoding(data []uint8) (encoding Encoding, bom bool) {
+  for e, mark := range byteOrderMarks {
+    if mark != nil && bytes.HasPrefix(data, mark) {
+      return Encoding(e), true
+    }
+  }
+  if e, ok := guessUTF16(data); ok {
+    if _, err := DecodeText(data, e, false); err == nil {
+      return e, false
+    }
+  }
+  if utf8.Valid(data) {
+    return ENCODING_UTF8, false
+  }
+  return ENCODING_LATIN1, false
+}
+
+// The smallest file that's guessed to be UTF-16 without a byte order
+// mark, in code units. Shorter files don't say enough to tell.
+const minUTF16Guess = 4
+
+// Check whether the start of some text looks like UTF-16: at least
+// three quarters of the code units have a zero high byte, and none
+// have a zero low byte.
+func guessUTF16(data []uint8) (Encoding, bool) {
+  if len(data) < 2*minUTF16Guess || len(data)%2 != 0 || bytes.IndexByte(data, 0) < 0 {
+    return ENCODING_UTF8, false
+  }
+  sample := data
+  if len(sample) > 4096 {
+    sample = sample[:4096]
+  }
+  var zeros [2]int
+  for i, b := range sample {
+    if b == 0 {
+      zeros[i%2]++
+    }
+  }
+  units := len(sample) / 2
+  if zeros[1] >= units*3/4 && zeros[0] == 0 {
+    return ENCODING_UTF16LE, true
+  } else if zeros[0] >= units*3/4 && zeros[1] == 0 {
+    return ENCODING_UTF16BE, true
+  }
+  return ENCODING_UTF8, false
+}
+
+// Decode the contents of a file to UTF-8, skipping the byte order mark
+// if bom is set. UTF-8 text isn't checked, since buffers can hold any
+// bytes at all.
+func DecodeText(data []uint8, encoding Encoding, bom bool) ([]uint8, error) {
+  offset := 0
+  if bom && bytes.HasPrefix(data, byteOrderMarks[encoding]) {
+    offset = len(byteOrderMarks[encoding])
+    data = data[offset:]
+  }
+  switch encoding {
+  case ENCODING_LATIN1:
+    result := make([]uint8, 0, len(data))
+    for _, b := range data {
+      result = utf8.AppendRune(result, rune(b))
+    }
+    return result, nil
+  case ENCODING_UTF16LE, ENCODING_UTF16BE:
+    return decodeUTF16(data, encoding, offset)
+  }
+  return data, nil
+}
+
+// Decode UTF-16 data, which starts offset bytes into the file.
+func decodeUTF16(data []uint8, encoding Encoding, offset int) ([]uint8, error) {
+  if len(data)%2 != 0 {
+    return nil, &EncodingError{encoding, offset + len(data) - 1, rune(data[len(data)-1]), true}
+  }
+  units := make([]uint16, len(data)/2)
+  for i := range units {
+    if encoding == ENCODING_UTF16LE {
+      units[i] = uint16(data[2*i]) | uint16(data[2*i+1])<<8
+    } else {
+      units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+    }
+  }
+  result := make([]uint8, 0, len(units))
+  for i := 0; i < len(units); i++ {
+    r := rune(units[i])
+    if utf16.IsSurrogate(r) {
+      if i+1 < len(units) {
+        r = utf16.DecodeRune(r, rune(units[i+1]))
+      } else {
+        r = utf8.RuneError
+      }
+      if r == utf8.RuneError {
+        return nil, &EncodingError{encoding, offset + 2*i, rune(units[i]), true}
+      }
+      i++
+    }
+    result = utf8.AppendRune(result, r)
+  }
+  return result, nil
+}
+
+// Encode UTF-8 text for a file, starting with a byte order mark if
+// bom is set.
+func EncodeText(text []uint8, encoding Encoding, bom bool) ([]uint8, error) {
+  result := make([]uint8, 0, len(text)+4)
+  if bom {
+    result = append(result, byteOrderMarks[encoding]...)
+  }
+  if encoding == ENCODING_UTF8 {
+    return append(result, text...), nil
+  }
+  for pos := 0; pos < len(text); {
+    r, size := utf8.DecodeRune(text[pos:])
+    if r == utf8.RuneError && size == 1 {
+      return nil, &EncodingError{encoding, pos, rune(text[pos]), false}
+    }
+    switch encoding {
+    case ENCODING_LATIN1:
+      if r > 0xFF {
+        return nil, &EncodingError{encoding, pos, r, false}
+      }
+      result = append(result, uint8(r))
+    case ENCODING_UTF16LE, ENCODING_UTF16BE:
+      units := []uint16{uint16(r)}
+      if r >= 0x10000 {
+        hi, lo := utf16.EncodeRune(r)
+        units = []uint16{uint16(hi), uint16(lo)}
+      }
+      for _, u := range units {
+        if encoding == ENCODING_UTF16LE {
+          result = append(result, uint8(u), uint8(u>>8))
+        } else {
+          result = append(result, uint8(u>>8), uint8(u))
+        }
+      }
+    }
+    pos += size
+  }
+  return result, nil
+}
+
+// Get the encoding that the buffer's file is written in, and whether
+// it starts with a byte order mark.
+func (self *fileFormat) Encoding() (Encoding, bool) { return self.encoding, self.bom }
+
+// Change the encoding that the buffer's file is written in. A byte
+// order mark is only written for UTF-8 and UTF-16. The buffer is dirty
+// if that changes the file.
+func (self *GapBuffer) SetEncoding(encoding Encoding, bom bool) {
+  bom = bom && byteOrderMarks[encoding] != nil
+  if encoding != self.encoding || bom != self.bom {
+    self.dirty = true
+  }
+  self.encoding = encoding
+  self.bom = bom
+}
@@ -0,0 +1,130 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: endings.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Line endings.
+//
+// Inside a buffer, every line ends with a single "\n", whatever the
+// file uses, so that lines and columns mean the same thing for every
+// file. When a file is read, its line ending style is detected from
+// the endings it uses most, and the endings in that style are
+// converted to "\n"; when it's written, they're converted back.
+//
+// A file that uses more than one style is flagged as mixed. Its text
+// is left exactly as it is, and written back the same way, since
+// there's no telling which of its carriage returns are line endings
+// and which are just carriage returns. SetLineEnding converts a mixed
+// buffer to a single style.
+
+package buf
+
+import (
+  "bytes"
+)
+
+type LineEnding int
+
+const (
+  LINE_ENDING_LF LineEnding = iota
+  LINE_ENDING_CRLF
+  LINE_ENDING_CR
+)
+
+var lineEndingText = [][]uint8{[]uint8("\n"), []uint8("\r\n"), []uint8("\r")}
+
+var lineEndingNames = []string{"LF", "CRLF", "CR"}
+
+func (self LineEnding) String() string { return lineEndingNames[self] }
+
+// Find the line ending style of some text, and whether it uses more
+// than one style. Text without any line endings is LINE_ENDING_LF.
+func DetectLineEnding(text []uint8) (ending LineEnding, mixed bool) {
+  var counts [3]int
+  for i := 0; i < len(text); i++ {
+    if text[i] == '\n' {
+      counts[LINE_ENDING_LF]++
+    } else if text[i] == '\r' {
+      if i+1 < len(text) && text[i+1] == '\n' {
+        counts[LINE_ENDING_CRLF]++
+        i++
+      } else {
+        counts[LINE_ENDING_CR]++
+      }
+    }
+  }
+  styles := 0
+  for e, count := range counts {
+    if count > 0 {
+      styles++
+    }
+    if count > counts[ending] {
+      ending = LineEnding(e)
+    }
+  }
+  return ending, styles > 1
+}
+
+// Convert all of the line endings in some text to one style.
+func ConvertLineEndings(text []uint8, ending LineEnding) []uint8 {
+  if bytes.IndexByte(text, '\r') >= 0 {
+    text = bytes.ReplaceAll(text, lineEndingText[LINE_ENDING_CRLF], lineEndingText[LINE_ENDING_LF])
+    text = bytes.ReplaceAll(text, lineEndingText[LINE_ENDING_CR], lineEndingText[LINE_ENDING_LF])
+  }
+  if ending == LINE_ENDING_LF {
+    return text
+  }
+  return bytes.ReplaceAll(text, lineEndingText[LINE_ENDING_LF], lineEndingText[ending])
+}
+
+// Convert the line endings in one style to "\n".
+func normalizeLineEndings(text []uint8, ending LineEnding) []uint8 {
+  if ending == LINE_ENDING_LF {
+    return text
+  }
+  return bytes.ReplaceAll(text, lineEndingText[ending], lineEndingText[LINE_ENDING_LF])
+}
+
+// Convert the text of the buffer to the line endings of its file.
+func (self *fileFormat) restoreLineEndings(text []uint8) []uint8 {
+  if self.mixed_ending || self.line_ending == LINE_ENDING_LF {
+    return text
+  }
+  return bytes.ReplaceAll(text, lineEndingText[LINE_ENDING_LF], lineEndingText[self.line_ending])
+}
+
+// Get the line ending style that the buffer's file is written with.
+// For a mixed file, this is the style that it uses most.
+func (self *fileFormat) LineEnding() LineEnding { return self.line_ending }
+
+// Check whether the buffer's file had more than one style of line
+// ending when it was read.
+func (self *fileFormat) HasMixedLineEndings() bool { return self.mixed_ending }
+
+// Change the line ending style that the buffer's file is written
+// with. The buffer is dirty if that changes the file. In a mixed
+// buffer, every line ending is converted to "\n", as an edit that can
+// be undone.
+func (self *GapBuffer) SetLineEnding(ending LineEnding) {
+  if ending != self.line_ending || self.mixed_ending {
+    self.dirty = true
+  }
+  if self.mixed_ending {
+    self.BeginUndoGroup()
+    self.replaceLines(ConvertLineEndings(self.Bytes(), LINE_ENDING_LF))
+    self.EndUndoGroup()
+  }
+  self.line_ending = ending
+  self.mixed_ending = false
+}
@@ -0,0 +1,139 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: errors.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: The errors returned by buffer operations.
+//
+// Each result code has an error, code.Err(), so the simplest failures
+// are just reported as that. Failures with more to say are reported
+// as typed errors that wrap a code's error: a position outside the
+// buffer is a *PositionError wrapping PAST_END or BEFORE_START, text
+// that can't be encoded is an *EncodingError wrapping ENCODING_ERROR,
+// and a failed file operation wraps both IO_ERROR and the error from
+// the os package (usually an *fs.PathError). Either way,
+// errors.Is(err, PAST_END.Err()) and friends work, and ResultCodeOf
+// turns an error back into a code for code that still works in terms
+// of result codes.
+
+package buf
+
+import (
+  "errors"
+  "fmt"
+)
+
+var resultCodeNames = []string{
+  "succeeded",
+  "past the end of the buffer",
+  "before the start of the buffer",
+  "too long",
+  "invalid",
+  "invalid range",
+  "invalid replacement",
+  "match failed",
+  "invalid line",
+  "invalid column",
+  "I/O error",
+  "encoding error",
+  "file changed on disk",
+}
+
+func (self ResultCode) String() string {
+  if int(self) < 0 || int(self) >= len(resultCodeNames) {
+    return fmt.Sprintf("result code %d", int(self))
+  }
+  return resultCodeNames[self]
+}
+
+// Get the error for a result code. SUCCEEDED has no error, so its
+// error is nil.
+func (self ResultCode) Err() error {
+  if self == SUCCEEDED {
+    return nil
+  }
+  return codeError(self)
+}
+
+// The error for a result code.
+type codeError ResultCode
+
+func (self codeError) Error() string { return "buf: " + ResultCode(self).String() }
+
+func (self codeError) ResultCode() ResultCode { return ResultCode(self) }
+
+// Get the result code for an error. A nil error is SUCCEEDED, and an
+// error that doesn't come from buf is treated as an IO_ERROR.
+func ResultCodeOf(err error) ResultCode {
+  if err == nil {
+    return SUCCEEDED
+  }
+  var code codeError
+  if errors.As(err, &code) {
+    return ResultCode(code)
+  }
+  return IO_ERROR
+}
+
+// A position that's outside of a buffer. Code is PAST_END or
+// BEFORE_START.
+type PositionError struct {
+  Code   ResultCode
+  Pos    int
+  Length int
+}
+
+func (self *PositionError) Error() string {
+  return fmt.Sprintf("%v: position %d in a buffer of length %d", self.Code.Err(), self.Pos, self.Length)
+}
+
+func (self *PositionError) Unwrap() error { return self.Code.Err() }
+
+// Check that pos is a position in a buffer of the given length, where
+// the end of the buffer counts as a position.
+func checkPosition(pos int, length int) error {
+  if pos < 0 {
+    return &PositionError{BEFORE_START, pos, length}
+  } else if pos > length {
+    return &PositionError{PAST_END, pos, length}
+  }
+  return nil
+}
+
+// Check that pos is the position of a character in a buffer of the
+// given length.
+func checkCharPosition(pos int, length int) error {
+  if pos >= length {
+    return &PositionError{PAST_END, pos, length}
+  }
+  return checkPosition(pos, length)
+}
+
+// Check the range of a GetRange call. The start has to be the
+// position of a character, and can't be after the end.
+func checkSpan(start int, end int, length int) error {
+  if err := checkCharPosition(start, length); err != nil {
+    return err
+  } else if err := checkPosition(end, length); err != nil {
+    return err
+  } else if start > end {
+    return INVALID_RANGE.Err()
+  }
+  return nil
+}
+
+// Wrap an error from a file operation.
+func ioError(err error) error {
+  return fmt.Errorf("%w: %w", IO_ERROR.Err(), err)
+}
@@ -0,0 +1,152 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: events.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Change events, for the things that need to know when
+//   the contents of a buffer change.
+//
+// Every change to the contents of a buffer is described by a change
+// event, and delivered to all of the buffer's listeners. Listeners
+// always receive a list of events: normally each list holds a single
+// event, but the events for the edits inside a batch are held back
+// until the outermost batch ends, and then delivered together.
+
+package buf
+
+type ChangeKind int
+
+const (
+  EDIT_CHANGE ChangeKind = iota
+  UNDO_CHANGE
+  REDO_CHANGE
+  RELOAD_CHANGE
+)
+
+// A change to a buffer: at Position, the bytes in Deleted were
+// replaced by the bytes in Inserted. The lines touched by the change
+// ran from StartLine to OldEndLine before it, and run from StartLine
+// to NewEndLine after it.
+type ChangeEvent struct {
+  Kind       ChangeKind
+  Position   int
+  Deleted    []uint8
+  Inserted   []uint8
+  StartLine  int
+  OldEndLine int
+  NewEndLine int
+}
+
+type ChangeListener interface {
+  BufferChanged(events []ChangeEvent)
+}
+
+// An adapter to allow an ordinary function to be used as a listener.
+type ChangeFunc func(events []ChangeEvent)
+
+func (self ChangeFunc) BufferChanged(events []ChangeEvent) { self(events) }
+
+type subscription struct {
+  id       int
+  listener ChangeListener
+}
+
+// The listener list and batching state, shared by all of the buffer
+// implementations.
+type changeNotifier struct {
+  listeners   []subscription
+  next_id     int
+  batch_depth int
+  pending     []ChangeEvent
+  kind        ChangeKind
+}
+
+// Add a listener to the buffer. The result identifies the
+// subscription, for Unsubscribe.
+func (self *changeNotifier) Subscribe(listener ChangeListener) int {
+  self.next_id++
+  self.listeners = append(self.listeners, subscription{self.next_id, listener})
+  return self.next_id
+}
+
+func (self *changeNotifier) Unsubscribe(id int) error {
+  for i, s := range self.listeners {
+    if s.id == id {
+      self.listeners = append(self.listeners[:i:i], self.listeners[i+1:]...)
+      return nil
+    }
+  }
+  return INVALID.Err()
+}
+
+// Start a batch of changes. Batches can be nested; nothing is
+// delivered until the outermost batch ends.
+func (self *changeNotifier) BeginChangeBatch() {
+  self.batch_depth++
+}
+
+func (self *changeNotifier) EndChangeBatch() error {
+  if self.batch_depth == 0 {
+    return INVALID.Err()
+  }
+  self.batch_depth--
+  if self.batch_depth == 0 && len(self.pending) > 0 {
+    events := self.pending
+    self.pending = nil
+    self.deliver(events)
+  }
+  return nil
+}
+
+func (self *changeNotifier) listening() bool { return len(self.listeners) > 0 }
+
+// Record a change at pos, which is on the given line. The change is
+// delivered immediately unless a batch is open.
+func (self *changeNotifier) changed(pos int, line int, deleted []uint8, inserted []uint8) {
+  if !self.listening() {
+    return
+  }
+  event := ChangeEvent{
+    Kind:       self.kind,
+    Position:   pos,
+    Deleted:    append([]uint8(nil), deleted...),
+    Inserted:   append([]uint8(nil), inserted...),
+    StartLine:  line,
+    OldEndLine: line + countNewlines(deleted),
+    NewEndLine: line + countNewlines(inserted),
+  }
+  if self.batch_depth > 0 {
+    self.pending = append(self.pending, event)
+  } else {
+    self.deliver([]ChangeEvent{event})
+  }
+}
+
+// Send events to the listeners. A listener can unsubscribe while
+// it's being called, so this works from a copy of the list.
+func (self *changeNotifier) deliver(events []ChangeEvent) {
+  listeners := append([]subscription(nil), self.listeners...)
+  for _, s := range listeners {
+    s.listener.BufferChanged(events)
+  }
+}
+
+func countNewlines(chars []uint8) (n int) {
+  for _, c := range chars {
+    if c == '\n' {
+      n++
+    }
+  }
+  return
+}
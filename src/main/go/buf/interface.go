@@ -18,9 +18,18 @@
 
 package buf
 
-// Every buffer operation that can fail should return a code
-// indicating whether the operation succeeded or not, and providing
-// an error code if they failed.
+import (
+  "time"
+)
+
+// Every buffer operation that can fail returns an error, which is nil
+// if the operation succeeded. Each kind of failure has a result code.
+// A result code isn't an error itself, so code written when the
+// operations returned result codes, like "b.Undo() != SUCCEEDED",
+// doesn't compile, rather than quietly testing the wrong thing; such
+// code can use ResultCodeOf(b.Undo()) instead. Callers can check for
+// a particular kind of failure with errors.Is(err, PAST_END.Err()).
+// See errors.go.
 
 /////////////////////////////////////////////////
 // Result codes
@@ -40,6 +49,8 @@ const (
   INVALID_LINE
   INVALID_COLUMN
   IO_ERROR
+  ENCODING_ERROR
+  FILE_CHANGED
 )
 
 
@@ -52,18 +63,19 @@ type EditBuffer interface {
 	// stateless interface methods
 	Length() int
 	Clear() 
-	GetCharAt(pos int) (uint8, ResultCode)
-	GetRange(start int, end int) ([]uint8, ResultCode)
-	GetPositionOfLine(linenum int) (int, ResultCode)
-	GetPositionOfLineAndColumn(linenum int, colnum int) (pos int, result ResultCode);
-	GetCoordinates(pos int) (line int, col int, status ResultCode)
+	GetCharAt(pos int) (uint8, error)
+	GetRange(start int, end int) ([]uint8, error)
+	GetPositionOfLine(linenum int) (int, error)
+	GetPositionOfLineAndColumn(linenum int, colnum int) (pos int, err error);
+	GetCoordinates(pos int) (line int, col int, err error)
+	LineCount() int
 	
 	// cursor-based interface methods	
 	MoveCursorTo(pos int)
 	MoveToLine(linenum int)
 	MoveCursorBy(distance int)
-	StepCursorBackward() ResultCode
-	StepCursorForward() ResultCode
+	StepCursorBackward() error
+	StepCursorForward() error
 	GetCurrentPosition() int
 	GetCurrentLine() int
 	GetCurrentColumn() int
@@ -72,9 +84,35 @@ type EditBuffer interface {
 	InsertString(s string)
 	Cut(numChars int) ([]uint8)
 	Copy(numChars int) ([]uint8)
+
+	// undo/redo
+	Undo() error
+	Redo() error
+	CanUndo() bool
+	CanRedo() bool
+
+	// change events
+	Subscribe(listener ChangeListener) int
+	Unsubscribe(id int) error
+	BeginChangeBatch()
+	EndChangeBatch() error
+}
+
+// An edit buffer that holds the contents of a file, which it can read
+// and save. See io.go and reload.go.
+type FileBuffer interface {
+	EditBuffer
+	GetFilename() string
+	IsDirty() bool
+	Read() error
+	Write() error
+	ForceWrite() error
+	ChangedOnDisk() (bool, error)
 }
 
 type UndoOperation interface {
   Undo()
+  Redo()
+  Timestamp() time.Time
 }
 
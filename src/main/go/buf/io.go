@@ -28,17 +28,78 @@ func (self *GapBuffer) GetFilename() string {
   return self.filename
 }
 
-func (self *GapBuffer) Read() ResultCode {
-  self.Clear()
+func (self *GapBuffer) Read() error {
+  // Listeners see the reload as a single batch of changes.
+  self.kind = RELOAD_CHANGE
+  self.BeginChangeBatch()
+  defer func() {
+    self.EndChangeBatch()
+    self.kind = EDIT_CHANGE
+  }()
+  // The file is read and decoded before the buffer is cleared, so
+  // that a file that can't be read leaves the buffer as it was.
   contents, err := ioutil.ReadFile(self.filename)
   if err != nil {
-    // TODO: need more specific errors - use os.Error code
-    // to generate some more specific error description.
-    return IO_ERROR
-  } else {
-    self.InsertChars(contents)
+    return ioError(err)
+  }
+  text, err := self.decodeFile(contents)
+  if err != nil {
+    return err
+  }
+  self.Clear()
+  self.insertChars(text)
+  // Loading the file isn't an edit that can be undone, and leaves the
+  // buffer matching the file.
+  self.resetUndo()
+  self.recordDisk(contents)
+  self.dirty = false
+  return nil
+}
+
+// How a buffer's file is encoded. The text of the buffer is UTF-8,
+// with "\n" line endings unless the file's were mixed; see encoding.go
+// and endings.go.
+type fileFormat struct {
+  encoding     Encoding
+  bom          bool
+  line_ending  LineEnding
+  mixed_ending bool
+}
+
+// Decode the contents of the buffer's file, recording its encoding
+// and line ending style. If it can't be decoded, the format is left
+// as it was.
+func (self *fileFormat) decodeFile(contents []uint8) ([]uint8, error) {
+  encoding, bom := DetectEncoding(contents)
+  text, err := DecodeText(contents, encoding, bom)
+  if err != nil {
+    return nil, err
+  }
+  self.encoding, self.bom = encoding, bom
+  self.line_ending, self.mixed_ending = DetectLineEnding(text)
+  if self.mixed_ending {
+    return text, nil
+  }
+  return normalizeLineEndings(text, self.line_ending), nil
+}
+
+// Encode the text of a buffer for its file.
+func (self *fileFormat) encodeFile(text []uint8) ([]uint8, error) {
+  bytes, err := EncodeText(self.restoreLineEndings(text), self.encoding, self.bom)
+  if err != nil {
+    // Converting line endings can move the text, so encode it again
+    // to find where the error is in the text itself.
+    _, err = EncodeText(text, self.encoding, false)
+    return nil, err
   }
-  return 0
+  return bytes, nil
+}
+
+// Check whether the text of a buffer is written to its file exactly
+// as it is.
+func (self *fileFormat) isVerbatim() bool {
+  return self.encoding == ENCODING_UTF8 && !self.bom &&
+    (self.mixed_ending || self.line_ending == LINE_ENDING_LF)
 }
 
 func fileExists(filename string) bool {
@@ -47,21 +108,35 @@ func fileExists(filename string) bool {
     return false
 }  
 
-func (self *GapBuffer) Write() ResultCode {
+// Save the buffer to its file. If the file has changed since the
+// buffer last read or wrote it, this returns FILE_CHANGED instead;
+// see reload.go.
+func (self *GapBuffer) Write() error {
   if !self.dirty {
-    return SUCCEEDED
+    return nil
   }
-  if fileExists(self.filename + ".bak") {
-    os.Remove(self.filename + ".bak")
+  if changed, _ := self.ChangedOnDisk(); changed {
+    return fileChangedError(self.filename)
   }
-  if fileExists(self.filename) {
-    os.Rename(self.filename, self.filename + ".bak")
-  }
-  bytes := self.Bytes()
-  err := ioutil.WriteFile(self.filename, bytes, 0544)
+  return self.write()
+}
+
+func (self *GapBuffer) write() error {
+  bytes, err := self.encodeFile(self.Bytes())
   if err != nil {
-    return IO_ERROR	
+    return err
+  }
+  filename := saveTarget(self.filename)
+  if err := self.backup.backup(filename); err != nil {
+    return ioError(err)
+  }
+  if err := writeFileAtomic(filename, bytes); err != nil {
+    return err
   }
   self.dirty = false
-  return SUCCEEDED
+  self.recordDisk(bytes)
+  if self.keep_undo {
+    return self.writeUndoFile(self.disk.hash)
+  }
+  return nil
 }
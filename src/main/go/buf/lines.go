@@ -0,0 +1,101 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: lines.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: An index of the newlines in a gap buffer.
+//
+// The index is split at the gap, just like the buffer itself.
+// pre_lines holds the positions of the newlines before the gap, in
+// increasing order. post_lines holds the newlines after the gap as
+// distances from the end of the buffer, also in increasing order - so
+// the newline closest to the gap is at the end of both lists.
+// Since edits only ever happen at the gap, keeping the index up to
+// date only ever means pushing or popping entries at the end of one of
+// the two lists - and since neither list stores positions relative to
+// the other side of the gap, nothing ever needs to be renumbered. When
+// the gap moves, the entries for the newlines that it moves over are
+// transferred from the end of one list to the end of the other.
+
+package buf
+
+import (
+  "sort"
+)
+
+// Transfer the index entries for newlines at or after pos from the
+// pre-gap list to the post-gap list, after the gap has moved back
+// to pos.
+func (self *GapBuffer) moveLinesToPost(pos int) {
+  first := sort.SearchInts(self.pre_lines, pos)
+  for i := len(self.pre_lines) - 1; i >= first; i-- {
+    self.post_lines = append(self.post_lines, self.Length()-1-self.pre_lines[i])
+  }
+  self.pre_lines = self.pre_lines[:first]
+}
+
+// Transfer the index entries for newlines before pos from the
+// post-gap list to the pre-gap list, after the gap has moved forward
+// to pos.
+func (self *GapBuffer) moveLinesToPre(pos int) {
+  for len(self.post_lines) > 0 {
+    nl := self.Length() - 1 - self.post_lines[len(self.post_lines)-1]
+    if nl >= pos {
+      break
+    }
+    self.pre_lines = append(self.pre_lines, nl)
+    self.post_lines = self.post_lines[:len(self.post_lines)-1]
+  }
+}
+
+// The number of newlines in the buffer.
+func (self *GapBuffer) newlineCount() int {
+  return len(self.pre_lines) + len(self.post_lines)
+}
+
+// The position of the n'th newline in the buffer, counting from 0.
+func (self *GapBuffer) newlinePosition(n int) int {
+  if n < len(self.pre_lines) {
+    return self.pre_lines[n]
+  }
+  n -= len(self.pre_lines)
+  return self.Length() - 1 - self.post_lines[len(self.post_lines)-1-n]
+}
+
+// The number of newlines at positions before pos.
+func (self *GapBuffer) newlinesBefore(pos int) int {
+  if pos <= self.PreLength() {
+    return sort.SearchInts(self.pre_lines, pos)
+  }
+  // A newline whose distance from the end is k is at position
+  // Length()-1-k, so it's before pos exactly when k >= Length()-pos.
+  after := sort.SearchInts(self.post_lines, self.Length()-pos)
+  return len(self.pre_lines) + len(self.post_lines) - after
+}
+
+// The position of the start of the line containing pos.
+func (self *GapBuffer) lineStart(pos int) int {
+  n := self.newlinesBefore(pos)
+  if n == 0 {
+    return 0
+  }
+  return self.newlinePosition(n-1) + 1
+}
+
+// The number of lines in the buffer. A buffer always has at least
+// one line, even if it's empty; a newline at the end of the buffer
+// starts a new, empty, line.
+func (self *GapBuffer) LineCount() int {
+  return self.newlineCount() + 1
+}
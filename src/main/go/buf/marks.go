@@ -0,0 +1,118 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: marks.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Marks - positions in a buffer that move with the text
+//   around them as the buffer is edited.
+
+package buf
+
+// The gravity of a mark decides what happens when text is inserted
+// exactly at the mark. A mark with left gravity stays where it is, so
+// the new text ends up after it; a mark with right gravity moves to
+// the end of the new text.
+type Gravity int
+
+const (
+  LEFT_GRAVITY Gravity = iota
+  RIGHT_GRAVITY
+)
+
+type Mark struct {
+  pos     int
+  gravity Gravity
+}
+
+func (self *Mark) Position() int { return self.pos }
+
+func (self *Mark) Gravity() Gravity { return self.gravity }
+
+// Create an anonymous mark. The mark is updated by every edit to the
+// buffer until it's released with ReleaseMark.
+func (self *GapBuffer) NewMark(pos int, gravity Gravity) (*Mark, error) {
+  if err := checkPosition(pos, self.Length()); err != nil {
+    return nil, err
+  }
+  mark := &Mark{pos, gravity}
+  self.positions = append(self.positions, mark)
+  return mark, nil
+}
+
+// Stop tracking an anonymous mark.
+func (self *GapBuffer) ReleaseMark(mark *Mark) {
+  for i, m := range self.positions {
+    if m == mark {
+      self.positions = append(self.positions[:i], self.positions[i+1:]...)
+      return
+    }
+  }
+}
+
+// Set a named mark, with left gravity. If there's already a mark
+// with the name, it's moved.
+func (self *GapBuffer) SetMark(name string, pos int) error {
+  return self.SetMarkWithGravity(name, pos, LEFT_GRAVITY)
+}
+
+func (self *GapBuffer) SetMarkWithGravity(name string, pos int, gravity Gravity) error {
+  mark, err := self.NewMark(pos, gravity)
+  if err != nil {
+    return err
+  }
+  if old, ok := self.marks[name]; ok {
+    self.ReleaseMark(old)
+  }
+  self.marks[name] = mark
+  return nil
+}
+
+func (self *GapBuffer) GetMark(name string) (int, error) {
+  mark, ok := self.marks[name]
+  if !ok {
+    return 0, INVALID.Err()
+  }
+  return mark.pos, nil
+}
+
+func (self *GapBuffer) DeleteMark(name string) error {
+  mark, ok := self.marks[name]
+  if !ok {
+    return INVALID.Err()
+  }
+  self.ReleaseMark(mark)
+  delete(self.marks, name)
+  return nil
+}
+
+// Update the marks for n characters inserted at pos.
+func (self *GapBuffer) marksInserted(pos int, n int) {
+  for _, m := range self.positions {
+    if m.pos > pos || (m.pos == pos && m.gravity == RIGHT_GRAVITY) {
+      m.pos += n
+    }
+  }
+}
+
+// Update the marks for n characters deleted at pos. Marks inside the
+// deleted text end up at pos.
+func (self *GapBuffer) marksDeleted(pos int, n int) {
+  for _, m := range self.positions {
+    if m.pos >= pos+n {
+      m.pos -= n
+    } else if m.pos > pos {
+      m.pos = pos
+    }
+  }
+}
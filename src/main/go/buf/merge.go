@@ -0,0 +1,220 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: merge.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Line diffs, and three-way merges built on them.
+//
+// The diff is Myers' O(ND) algorithm, run on whatever is left after
+// the common prefix and suffix are trimmed away, so comparing two
+// versions of a file costs time and space proportional to how much
+// they differ rather than to how long they are. The merge is diff3's:
+// it diffs both of the new versions against their common base, and
+// takes each change from whichever side made it. Where both sides
+// changed the same or adjacent lines in different ways, it writes
+// both versions between conflict markers.
+
+package buf
+
+import (
+  "strings"
+)
+
+// A change between two lists of lines: lines a_start to a_end of the
+// old list were replaced by lines b_start to b_end of the new one.
+type lineHunk struct {
+  a_start, a_end int
+  b_start, b_end int
+}
+
+// Split text into lines, each with its newline (if it has one).
+func splitLines(text []uint8) []string {
+  lines := strings.SplitAfter(string(text), "\n")
+  if lines[len(lines)-1] == "" {
+    lines = lines[:len(lines)-1]
+  }
+  return lines
+}
+
+// Find the changes that turn the lines a into the lines b, in order.
+func diffLines(a []string, b []string) []lineHunk {
+  prefix := 0
+  for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+    prefix++
+  }
+  suffix := 0
+  for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+    a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+    suffix++
+  }
+  a = a[prefix : len(a)-suffix]
+  b = b[prefix : len(b)-suffix]
+  if len(a) == 0 && len(b) == 0 {
+    return nil
+  }
+
+  // matches holds the pairs of equal lines, from the end backwards.
+  var matches [][2]int
+  x, y := len(a), len(b)
+  snaps := myersSnapshots(a, b)
+  for d := len(snaps) - 1; d > 0; d-- {
+    prev := snaps[d-1]
+    get := func(k int) int { return prev[k+d-1] }
+    k := x - y
+    prev_k := k - 1
+    if k == -d || (k != d && get(k-1) < get(k+1)) {
+      prev_k = k + 1
+    }
+    prev_x := get(prev_k)
+    prev_y := prev_x - prev_k
+    for x > prev_x && y > prev_y {
+      x, y = x-1, y-1
+      matches = append(matches, [2]int{x, y})
+    }
+    x, y = prev_x, prev_y
+  }
+  for x > 0 {
+    x, y = x-1, y-1
+    matches = append(matches, [2]int{x, y})
+  }
+
+  var hunks []lineHunk
+  i, j := 0, 0
+  for m := len(matches) - 1; m >= -1; m-- {
+    next := [2]int{len(a), len(b)}
+    if m >= 0 {
+      next = matches[m]
+    }
+    if next[0] > i || next[1] > j {
+      hunks = append(hunks, lineHunk{prefix + i, prefix + next[0], prefix + j, prefix + next[1]})
+    }
+    i, j = next[0]+1, next[1]+1
+  }
+  return hunks
+}
+
+// Run the forward pass of Myers' algorithm. Entry d of the result
+// holds, for each diagonal k from -d to d, the furthest x reached
+// along it with d edits, at index k+d.
+func myersSnapshots(a []string, b []string) [][]int {
+  n, m := len(a), len(b)
+  off := n + m + 1
+  v := make([]int, 2*off+1)
+  var snaps [][]int
+  for d := 0; ; d++ {
+    done := false
+    for k := -d; k <= d; k += 2 {
+      var x int
+      if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+        x = v[off+k+1]
+      } else {
+        x = v[off+k-1] + 1
+      }
+      y := x - k
+      for x < n && y < m && a[x] == b[y] {
+        x, y = x+1, y+1
+      }
+      v[off+k] = x
+      if x >= n && y >= m {
+        done = true
+      }
+    }
+    snaps = append(snaps, append([]int(nil), v[off-d:off+d+1]...))
+    if done {
+      return snaps
+    }
+  }
+}
+
+// Merge the changes that turned base into mine and into theirs.
+// Conflicting changes are both kept, between conflict markers that
+// name them mine_label and theirs_label. Returns the merged text and
+// the number of conflicts.
+func mergeText(base []uint8, mine []uint8, theirs []uint8,
+  mine_label string, theirs_label string) ([]uint8, int) {
+  base_lines := splitLines(base)
+  sides := [2][]string{splitLines(mine), splitLines(theirs)}
+  hunks := [2][]lineHunk{diffLines(base_lines, sides[0]), diffLines(base_lines, sides[1])}
+
+  var result strings.Builder
+  write := func(lines []string) {
+    for _, line := range lines {
+      result.WriteString(line)
+    }
+  }
+  conflicts := 0
+  pos := 0
+  for len(hunks[0]) > 0 || len(hunks[1]) > 0 {
+    // Collect a group of overlapping hunks, starting with the first.
+    first := 0
+    if len(hunks[0]) == 0 || (len(hunks[1]) > 0 && hunks[1][0].a_start < hunks[0][0].a_start) {
+      first = 1
+    }
+    lo, hi := hunks[first][0].a_start, hunks[first][0].a_end
+    var group [2][]lineHunk
+    for {
+      side := -1
+      for s := 0; s < 2; s++ {
+        if len(hunks[s]) > 0 && hunks[s][0].a_start <= hi &&
+          (side < 0 || hunks[s][0].a_start < hunks[side][0].a_start) {
+          side = s
+        }
+      }
+      if side < 0 {
+        break
+      }
+      h := hunks[side][0]
+      hunks[side] = hunks[side][1:]
+      group[side] = append(group[side], h)
+      hi = max(hi, h.a_end)
+    }
+
+    write(base_lines[pos:lo])
+    var regions [2][]string
+    for s := 0; s < 2; s++ {
+      if len(group[s]) == 0 {
+        regions[s] = base_lines[lo:hi]
+      } else {
+        first, last := group[s][0], group[s][len(group[s])-1]
+        regions[s] = sides[s][first.b_start-(first.a_start-lo) : last.b_end+(hi-last.a_end)]
+      }
+    }
+    if len(group[1]) == 0 {
+      write(regions[0])
+    } else if len(group[0]) == 0 || strings.Join(regions[0], "") == strings.Join(regions[1], "") {
+      write(regions[1])
+    } else {
+      conflicts++
+      result.WriteString("<<<<<<< " + mine_label + "\n")
+      writeTerminated(&result, regions[0])
+      result.WriteString("=======\n")
+      writeTerminated(&result, regions[1])
+      result.WriteString(">>>>>>> " + theirs_label + "\n")
+    }
+    pos = hi
+  }
+  write(base_lines[pos:])
+  return []uint8(result.String()), conflicts
+}
+
+// Write lines inside a conflict, making sure that the marker after
+// them starts on a line of its own.
+func writeTerminated(result *strings.Builder, lines []string) {
+  for _, line := range lines {
+    result.WriteString(line)
+  }
+  if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+    result.WriteString("\n")
+  }
+}
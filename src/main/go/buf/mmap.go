@@ -0,0 +1,133 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: mmap.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Buffers backed by memory-mapped files.
+//
+// A mapped buffer is a piece table whose original text is a read-only
+// memory mapping of the file. Nothing is read when the buffer is
+// opened: the operating system faults pages of the file in as they're
+// touched, and can drop them again under memory pressure. Edits live
+// in the piece table's add buffer, as an overlay on top of the file.
+// Lines are found through a sparse index that's built as the file is
+// read (see piecelines.go), so moving around near one end of a huge
+// file doesn't scan the whole thing.
+//
+// The mapping reflects the file on disk, so the file must not be
+// truncated or rewritten by another program while it's open. Saving
+// the buffer replaces the file with a new one, which leaves the old
+// mapping intact, and then maps the new file in its place. The undo
+// history refers to the old mapping, so it starts again after a save.
+// A mapped file isn't hashed when it's read, so any change to its
+// size or modification time counts as a change to it.
+
+package buf
+
+import (
+  "os"
+)
+
+type MappedBuffer struct {
+  *PieceTable
+  data []uint8
+}
+
+// Open a file as a memory-mapped buffer. The buffer must be closed
+// when it's no longer needed, to release the mapping.
+func NewMappedFileBuffer(filename string) (buf *MappedBuffer, err error) {
+  buf = &MappedBuffer{newPieceTable(nil, 0), nil}
+  buf.filename = filename
+  if err = buf.Read(); err != nil {
+    return nil, err
+  }
+  return buf, nil
+}
+
+// Map the file as it is now, replacing the text of the buffer. This
+// can't be undone.
+func (self *MappedBuffer) Read() error {
+  if err := self.remap(); err != nil {
+    return err
+  }
+  self.disk.record(self.filename, "", 0)
+  return nil
+}
+
+// Save the buffer to its file, and map the file that was written.
+func (self *MappedBuffer) Write() error {
+  if !self.dirty {
+    return nil
+  }
+  if err := self.PieceTable.Write(); err != nil {
+    return err
+  }
+  return self.remap()
+}
+
+// Write the buffer even if its file has changed on disk.
+func (self *MappedBuffer) ForceWrite() error {
+  if !self.dirty {
+    return nil
+  }
+  if err := self.PieceTable.ForceWrite(); err != nil {
+    return err
+  }
+  return self.remap()
+}
+
+// Replace the text of the buffer with a new mapping of its file, and
+// release the old mapping.
+func (self *MappedBuffer) remap() error {
+  file, err := os.Open(self.filename)
+  if err != nil {
+    return ioError(err)
+  }
+  defer file.Close()
+  stat, err := file.Stat()
+  if err != nil {
+    return ioError(err)
+  }
+  var data []uint8
+  if stat.Size() > 0 {
+    data, err = mapFile(file, int(stat.Size()))
+    if err != nil {
+      return ioError(err)
+    }
+  }
+  old := self.data
+  self.load(data)
+  self.data = data
+  if old != nil {
+    if err := unmapFile(old); err != nil {
+      return ioError(err)
+    }
+  }
+  return nil
+}
+
+// Release the file mapping. The buffer can't be used after it's
+// been closed.
+func (self *MappedBuffer) Close() error {
+  if self.data == nil {
+    return nil
+  }
+  err := unmapFile(self.data)
+  self.data = nil
+  self.PieceTable = nil
+  if err != nil {
+    return ioError(err)
+  }
+  return nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: mmap_other.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: A fallback for systems without mmap, which just reads
+//   the whole file into memory.
+
+//go:build !unix
+
+package buf
+
+import (
+  "io"
+  "os"
+)
+
+func mapFile(file *os.File, size int) ([]uint8, error) {
+  data := make([]uint8, size)
+  _, err := io.ReadFull(file, data)
+  return data, err
+}
+
+func unmapFile(data []uint8) error {
+  return nil
+}
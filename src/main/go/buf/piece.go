@@ -0,0 +1,476 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: piece.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: A piece-table implementation of EditBuffer.
+//
+// A piece table never modifies the text it was loaded with. Inserted
+// text is appended to a separate add buffer, and the contents of the
+// buffer are described by a list of pieces, each of which is a span
+// of either the original text or the add buffer. Every edit replaces
+// a short run of pieces with a new run, so undoing an edit just means
+// putting the old run of pieces back.
+
+package buf
+
+import (
+  "bytes"
+  "io"
+  "unicode/utf8"
+)
+
+// A span of one of the two underlying texts.
+type piece struct {
+  added  bool
+  start  int
+  length int
+}
+
+// A record of an edit: the old pieces starting at index were replaced
+// by the new pieces. pos is where the edit happened, and deleted and
+// inserted are the characters that it removed and added.
+type pieceChange struct {
+  index    int
+  old      []piece
+  pieces   []piece
+  pos      int
+  deleted  []uint8
+  inserted []uint8
+}
+
+type PieceTable struct {
+  original   []uint8
+  added      []uint8
+  pieces     []piece
+  length     int
+  cursor     int
+  line       int
+  column     int
+  undo_stack []*pieceChange
+  redo_stack []*pieceChange
+  dirty      bool
+  filename   string
+  disk       diskState
+  backup     BackupPolicy
+  index      lineIndex
+  changeNotifier
+}
+
+// Create a new, empty, piece table.
+func NewPieceTable(size int) *PieceTable {
+  return newPieceTable(nil, size)
+}
+
+// Create a piece table for the contents of a file. The file contents
+// are never modified.
+func NewPieceTableFile(filename string) (buf *PieceTable, err error) {
+  buf = newPieceTable(nil, 0)
+  buf.filename = filename
+  if err = buf.Read(); err != nil {
+    return nil, err
+  }
+  return buf, nil
+}
+
+func newPieceTable(original []uint8, size int) *PieceTable {
+  result := new(PieceTable)
+  result.original = original
+  result.added = make([]uint8, 0, size)
+  result.pieces = make([]piece, 0, 16)
+  if len(original) > 0 {
+    result.pieces = append(result.pieces, piece{false, 0, len(original)})
+  }
+  result.length = len(original)
+  result.line = 1
+  result.undo_stack = make([]*pieceChange, 0, 100)
+  result.redo_stack = make([]*pieceChange, 0, 100)
+  result.backup = DefaultBackupPolicy
+  return result
+}
+
+////////////////////////////////////////////////////////////////
+// Primitives.
+
+func (self *PieceTable) text(p piece) []uint8 {
+  if p.added {
+    return self.added[p.start : p.start+p.length]
+  }
+  return self.original[p.start : p.start+p.length]
+}
+
+// Find the piece containing a position, and the offset of the
+// position within that piece. The end of the buffer is reported as
+// offset 0 in a piece just past the end of the piece list.
+func (self *PieceTable) findPiece(pos int) (index int, offset int) {
+  for i, p := range self.pieces {
+    if pos < p.length {
+      return i, pos
+    }
+    pos -= p.length
+  }
+  return len(self.pieces), 0
+}
+
+// Call f on each chunk of text between start and end, in order.
+func (self *PieceTable) each(start int, end int, f func(chunk []uint8)) {
+  i, offset := self.findPiece(start)
+  for ; i < len(self.pieces) && start < end; i++ {
+    chunk := self.text(self.pieces[i])[offset:]
+    if len(chunk) > end-start {
+      chunk = chunk[:end-start]
+    }
+    f(chunk)
+    start += len(chunk)
+    offset = 0
+  }
+}
+
+// A reader for the runes of a piece table, which keeps its place in
+// the list of pieces instead of finding it again for every rune.
+type pieceReader struct {
+  table  *PieceTable
+  pos    int
+  index  int
+  offset int
+}
+
+func (self *PieceTable) runesFrom(pos int) io.RuneReader {
+  i, offset := self.findPiece(pos)
+  return &pieceReader{self, pos, i, offset}
+}
+
+func (self *pieceReader) ReadRune() (r rune, size int, err error) {
+  pieces := self.table.pieces
+  if self.index < len(pieces) {
+    if chunk := self.table.text(pieces[self.index])[self.offset:]; utf8.FullRune(chunk) {
+      r, size = utf8.DecodeRune(chunk)
+    }
+  }
+  if size == 0 {
+    // A rune split between pieces, or the end of the table.
+    if r, size, err = self.table.GetRuneAt(self.pos); err != nil {
+      return 0, 0, io.EOF
+    }
+  }
+  self.pos += size
+  self.offset += size
+  for self.index < len(pieces) && self.offset >= pieces[self.index].length {
+    self.offset -= pieces[self.index].length
+    self.index++
+  }
+  return r, size, nil
+}
+
+// Replace n characters starting at pos with chars. This is the only
+// way that the contents of the table ever change.
+func (self *PieceTable) splice(pos int, n int, chars []uint8) *pieceChange {
+  first, offset := self.findPiece(pos)
+  last, last_offset := self.findPiece(pos + n)
+  end := last
+  if last_offset > 0 {
+    end++
+  }
+  pieces := make([]piece, 0, 3)
+  if offset > 0 {
+    p := self.pieces[first]
+    pieces = append(pieces, piece{p.added, p.start, offset})
+  }
+  if len(chars) > 0 {
+    add_start := len(self.added)
+    self.added = append(self.added, chars...)
+    // When typing, each insert follows the last one, so rather than
+    // adding a new piece, extend the one that ends at the end of the
+    // add buffer.
+    prev := piece{}
+    if offset == 0 && first > 0 && n == 0 {
+      prev = self.pieces[first-1]
+    }
+    if prev.added && prev.start+prev.length == add_start {
+      first--
+      pieces = append(pieces, piece{true, prev.start, prev.length + len(chars)})
+    } else {
+      pieces = append(pieces, piece{true, add_start, len(chars)})
+    }
+  }
+  if last_offset > 0 {
+    p := self.pieces[last]
+    pieces = append(pieces, piece{p.added, p.start + last_offset, p.length - last_offset})
+  }
+  old := make([]piece, end-first)
+  copy(old, self.pieces[first:end])
+  deleted := make([]uint8, 0, n)
+  self.each(pos, pos+n, func(chunk []uint8) { deleted = append(deleted, chunk...) })
+  // The add buffer is only ever appended to, so the inserted text
+  // can be shared with it.
+  inserted := self.added[len(self.added)-len(chars):]
+  change := &pieceChange{first, old, pieces, pos, deleted, inserted}
+  self.replacePieces(first, old, pieces)
+  self.dirty = true
+  self.redo_stack = self.redo_stack[:0]
+  self.undo_stack = append(self.undo_stack, change)
+  if self.listening() {
+    line, _, _ := self.GetCoordinates(pos)
+    self.changed(pos, line, deleted, inserted)
+  }
+  return change
+}
+
+func (self *PieceTable) replacePieces(index int, old []piece, pieces []piece) {
+  rest := append([]piece(nil), self.pieces[index+len(old):]...)
+  self.pieces = append(append(self.pieces[:index], pieces...), rest...)
+  for _, p := range old {
+    self.length -= p.length
+  }
+  for _, p := range pieces {
+    self.length += p.length
+  }
+}
+
+// Recompute the cursor's line and column from scratch.
+func (self *PieceTable) setCursor(pos int) {
+  self.cursor = pos
+  self.line, self.column, _ = self.GetCoordinates(pos)
+}
+
+////////////////////////////////////////////////////////////////
+// Stateless methods.
+
+func (self *PieceTable) Length() int { return self.length }
+
+func (self *PieceTable) Clear() {
+  self.MoveCursorTo(0)
+  self.Cut(self.Length())
+}
+
+func (self *PieceTable) GetCharAt(pos int) (uint8, error) {
+  if err := checkCharPosition(pos, self.length); err != nil {
+    return 0, err
+  }
+  i, offset := self.findPiece(pos)
+  return self.text(self.pieces[i])[offset], nil
+}
+
+// Get the rune that starts at a byte position, along with its length
+// in bytes, as GapBuffer.GetRuneAt.
+func (self *PieceTable) GetRuneAt(pos int) (r rune, size int, err error) {
+  if err := checkCharPosition(pos, self.length); err != nil {
+    return utf8.RuneError, 0, err
+  }
+  chars, _ := self.GetRange(pos, min(pos+utf8.UTFMax, self.length))
+  r, size = utf8.DecodeRune(chars)
+  return r, size, nil
+}
+
+func (self *PieceTable) GetRange(start int, end int) ([]uint8, error) {
+  if err := checkSpan(start, end, self.length); err != nil {
+    return nil, err
+  }
+  result := make([]uint8, 0, end-start)
+  self.each(start, end, func(chunk []uint8) { result = append(result, chunk...) })
+  return result, nil
+}
+
+func (self *PieceTable) Bytes() []uint8 {
+  result := make([]uint8, 0, self.length)
+  self.each(0, self.length, func(chunk []uint8) { result = append(result, chunk...) })
+  return result
+}
+
+func (self *PieceTable) String() string { return string(self.Bytes()) }
+
+// For debugging purposes: return the text before and after the cursor.
+func (self *PieceTable) StringPair() (before string, after string) {
+  all := self.Bytes()
+  return string(all[:self.cursor]), string(all[self.cursor:])
+}
+
+func (self *PieceTable) IsDirty() bool { return self.dirty }
+
+func (self *PieceTable) GetFilename() string { return self.filename }
+
+func (self *PieceTable) GetPositionOfLineAndColumn(linenum int, colnum int) (pos int, err error) {
+  pos, err = self.GetPositionOfLine(linenum)
+  if err != nil {
+    return 0, INVALID_LINE.Err()
+  }
+  for i := 0; i < colnum; i++ {
+    if c, ok := self.GetCharAt(pos); ok == nil && c != '\n' {
+      pos++
+    } else {
+      return pos, INVALID_COLUMN.Err()
+    }
+  }
+  return pos, nil
+}
+
+////////////////////////////////////////////////////////////////
+// Cursor-based methods.
+
+func (self *PieceTable) MoveCursorTo(pos int) {
+  if pos < 0 {
+    pos = 0
+  } else if pos > self.length {
+    pos = self.length
+  }
+  self.setCursor(pos)
+}
+
+func (self *PieceTable) MoveToLine(linenum int) {
+  pos, err := self.GetPositionOfLine(linenum)
+  if err != nil && linenum > 1 {
+    pos = self.length
+  }
+  self.MoveCursorTo(pos)
+}
+
+func (self *PieceTable) MoveCursorBy(distance int) {
+  self.MoveCursorTo(self.cursor + distance)
+}
+
+func (self *PieceTable) StepCursorForward() error {
+  c, err := self.GetCharAt(self.cursor)
+  if err != nil {
+    return err
+  }
+  self.cursor++
+  if c == '\n' {
+    self.line++
+    self.column = 0
+  } else {
+    self.column++
+  }
+  return nil
+}
+
+func (self *PieceTable) StepCursorBackward() error {
+  if self.cursor == 0 {
+    return checkPosition(-1, self.Length())
+  }
+  if c, _ := self.GetCharAt(self.cursor - 1); c == '\n' {
+    self.cursor--
+    self.line--
+    self.column = self.columnOf(self.cursor)
+  } else {
+    self.cursor--
+    self.column--
+  }
+  return nil
+}
+
+func (self *PieceTable) GetCurrentPosition() int { return self.cursor }
+
+func (self *PieceTable) GetCurrentLine() int { return self.line }
+
+func (self *PieceTable) GetCurrentColumn() int { return self.column }
+
+func (self *PieceTable) InsertChar(c uint8) {
+  self.InsertChars([]uint8{c})
+}
+
+func (self *PieceTable) InsertChars(cs []uint8) {
+  if len(cs) == 0 {
+    return
+  }
+  self.splice(self.cursor, 0, cs)
+  self.cursor += len(cs)
+  if n := bytes.Count(cs, []uint8{'\n'}); n > 0 {
+    self.line += n
+    self.column = len(cs) - bytes.LastIndexByte(cs, '\n') - 1
+  } else {
+    self.column += len(cs)
+  }
+}
+
+func (self *PieceTable) InsertString(s string) {
+  self.InsertChars([]uint8(s))
+}
+
+func (self *PieceTable) Cut(numChars int) []uint8 {
+  start, end := self.cursor, self.cursor+numChars
+  if numChars < 0 {
+    start, end = self.cursor+numChars, self.cursor
+  }
+  if start < 0 {
+    start = 0
+  }
+  if end > self.length {
+    end = self.length
+  }
+  cutbuf := make([]uint8, 0, end-start)
+  self.each(start, end, func(chunk []uint8) { cutbuf = append(cutbuf, chunk...) })
+  if end > start {
+    self.splice(start, end-start, nil)
+  }
+  if start != self.cursor {
+    self.setCursor(start)
+  }
+  return cutbuf
+}
+
+func (self *PieceTable) Copy(numChars int) []uint8 {
+  start, end := self.cursor, self.cursor+numChars
+  if numChars < 0 {
+    start, end = self.cursor+numChars, self.cursor
+  }
+  if start < 0 {
+    start = 0
+  }
+  if end > self.length {
+    end = self.length
+  }
+  copybuf := make([]uint8, 0, end-start)
+  self.each(start, end, func(chunk []uint8) { copybuf = append(copybuf, chunk...) })
+  return copybuf
+}
+
+////////////////////////////////////////////////////////////////
+// Undo and redo. Nothing is ever removed from the add buffer, so
+// both just swap runs of pieces.
+
+func (self *PieceTable) Undo() error {
+  if !self.CanUndo() {
+    return INVALID.Err()
+  }
+  change := self.undo_stack[len(self.undo_stack)-1]
+  self.undo_stack = self.undo_stack[:len(self.undo_stack)-1]
+  self.replacePieces(change.index, change.pieces, change.old)
+  self.redo_stack = append(self.redo_stack, change)
+  self.dirty = true
+  self.setCursor(change.pos)
+  self.kind = UNDO_CHANGE
+  self.changed(change.pos, self.line, change.inserted, change.deleted)
+  self.kind = EDIT_CHANGE
+  return nil
+}
+
+func (self *PieceTable) Redo() error {
+  if !self.CanRedo() {
+    return INVALID.Err()
+  }
+  change := self.redo_stack[len(self.redo_stack)-1]
+  self.redo_stack = self.redo_stack[:len(self.redo_stack)-1]
+  self.replacePieces(change.index, change.old, change.pieces)
+  self.undo_stack = append(self.undo_stack, change)
+  self.dirty = true
+  self.setCursor(change.pos + len(change.inserted))
+  self.kind = REDO_CHANGE
+  self.changed(change.pos, self.line-countNewlines(change.inserted), change.deleted, change.inserted)
+  self.kind = EDIT_CHANGE
+  return nil
+}
+
+func (self *PieceTable) CanUndo() bool { return len(self.undo_stack) > 0 }
+
+func (self *PieceTable) CanRedo() bool { return len(self.redo_stack) > 0 }
@@ -0,0 +1,109 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// File: piecefile.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Reading and writing the files of piece tables.
+//
+// A piece table holds its file's bytes as they are, without decoding
+// them, so saving one just streams its pieces to the file, a piece at
+// a time. Otherwise it's saved like any other buffer: atomically, with
+// a backup, and refusing to write over a file that's changed since
+// the table last saw it.
+
+package buf
+
+import (
+  "os"
+)
+
+func (self *PieceTable) SetBackupPolicy(policy BackupPolicy) { self.backup = policy }
+
+func (self *PieceTable) GetBackupPolicy() BackupPolicy { return self.backup }
+
+// Replace the text of the table with the contents of its file. This
+// can't be undone.
+func (self *PieceTable) Read() error {
+  contents, err := os.ReadFile(self.filename)
+  if err != nil {
+    return ioError(err)
+  }
+  self.load(contents)
+  self.disk.record(self.filename, contentHash(contents), 0)
+  return nil
+}
+
+// Make original the whole text of the table, with no history.
+func (self *PieceTable) load(original []uint8) {
+  var old []uint8
+  if self.listening() {
+    old = self.Bytes()
+  }
+  self.original = original
+  self.added = nil
+  self.pieces = self.pieces[:0]
+  if len(original) > 0 {
+    self.pieces = append(self.pieces, piece{false, 0, len(original)})
+  }
+  self.length = len(original)
+  self.index = lineIndex{}
+  self.undo_stack = self.undo_stack[:0]
+  self.redo_stack = self.redo_stack[:0]
+  self.setCursor(min(self.cursor, self.length))
+  self.kind = RELOAD_CHANGE
+  self.changed(0, 1, old, original)
+  self.kind = EDIT_CHANGE
+  self.dirty = false
+}
+
+// Check whether the table's file has been changed since the table
+// last read or wrote it.
+func (self *PieceTable) ChangedOnDisk() (bool, error) {
+  return self.disk.changed(self.filename)
+}
+
+// Save the table to its file. If the file has changed since the table
+// last read or wrote it, this returns FILE_CHANGED instead.
+func (self *PieceTable) Write() error {
+  if !self.dirty {
+    return nil
+  }
+  if changed, _ := self.ChangedOnDisk(); changed {
+    return fileChangedError(self.filename)
+  }
+  return self.write()
+}
+
+// Write the table even if its file has changed on disk.
+func (self *PieceTable) ForceWrite() error {
+  if !self.dirty {
+    return nil
+  }
+  return self.write()
+}
+
+func (self *PieceTable) write() error {
+  write, hash := writeChunks(func(f func(chunk []uint8)) { self.each(0, self.length, f) })
+  filename := saveTarget(self.filename)
+  if err := self.backup.backup(filename); err != nil {
+    return ioError(err)
+  }
+  if err := writeFileStream(filename, write); err != nil {
+    return err
+  }
+  self.dirty = false
+  self.disk.record(self.filename, hash(), 0)
+  return nil
+}
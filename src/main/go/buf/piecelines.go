@@ -0,0 +1,175 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// File: piecelines.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Finding lines in piece tables.
+//
+// The original text of a piece table never changes, so it has a
+// sparse index of its newlines: the number of newlines before the
+// start of each block of lineIndexBlock bytes. Counting the newlines
+// in any span of the original text only has to look at the blocks at
+// either end of it. The index is built lazily, and only as far into
+// the text as it's been needed, so opening a mapped file still reads
+// nothing, and working near its start never touches the rest of it.
+// The add buffer holds only what's been typed or pasted, and is
+// scanned directly.
+
+package buf
+
+import (
+  "bytes"
+  "sort"
+)
+
+// The size of the blocks of original text that the line index counts.
+const lineIndexBlock = 64 * 1024
+
+// A sparse index of the newlines in a text that never changes.
+// counts[i] is the number of newlines before block i.
+type lineIndex struct {
+  counts []int
+}
+
+// Index the text up to the start of block n.
+func (self *lineIndex) extend(text []uint8, n int) {
+  if len(self.counts) == 0 {
+    self.counts = append(self.counts, 0)
+  }
+  for len(self.counts) <= n {
+    i := len(self.counts) - 1
+    block := text[i*lineIndexBlock : (i+1)*lineIndexBlock]
+    self.counts = append(self.counts, self.counts[i]+bytes.Count(block, []uint8{'\n'}))
+  }
+}
+
+// Count the newlines in text before pos.
+func (self *lineIndex) newlinesBefore(text []uint8, pos int) int {
+  block := pos / lineIndexBlock
+  self.extend(text, block)
+  return self.counts[block] + bytes.Count(text[block*lineIndexBlock:pos], []uint8{'\n'})
+}
+
+// Find the position just after the nth newline in text, counting from
+// one, or -1 if there aren't that many.
+func (self *lineIndex) afterNewline(text []uint8, n int) int {
+  self.extend(text, 0)
+  for last := len(self.counts) - 1; self.counts[last] < n && last < len(text)/lineIndexBlock; last++ {
+    self.extend(text, last+1)
+  }
+  // The last block that starts before the nth newline.
+  block := sort.Search(len(self.counts), func(i int) bool { return self.counts[i] >= n }) - 1
+  seen := self.counts[block]
+  for pos := block * lineIndexBlock; pos < len(text); {
+    i := bytes.IndexByte(text[pos:], '\n')
+    if i < 0 {
+      break
+    }
+    pos += i + 1
+    if seen++; seen == n {
+      return pos
+    }
+  }
+  return -1
+}
+
+// Count the newlines in the first n characters of a piece.
+func (self *PieceTable) newlinesIn(p piece, n int) int {
+  if p.added {
+    return bytes.Count(self.added[p.start:p.start+n], []uint8{'\n'})
+  }
+  return self.index.newlinesBefore(self.original, p.start+n) -
+    self.index.newlinesBefore(self.original, p.start)
+}
+
+// Find the offset just after the nth newline in a piece, counting
+// from one. The piece must have at least n newlines.
+func (self *PieceTable) afterNewlineIn(p piece, n int) int {
+  if p.added {
+    offset := 0
+    for ; n > 0; n-- {
+      offset += bytes.IndexByte(self.added[p.start+offset:p.start+p.length], '\n') + 1
+    }
+    return offset
+  }
+  before := self.index.newlinesBefore(self.original, p.start)
+  return self.index.afterNewline(self.original, before+n) - p.start
+}
+
+func (self *PieceTable) GetPositionOfLine(linenum int) (int, error) {
+  pos := 0
+  line := 1
+  for _, p := range self.pieces {
+    if line >= linenum {
+      break
+    }
+    n := self.newlinesIn(p, p.length)
+    if line+n >= linenum {
+      pos += self.afterNewlineIn(p, linenum-line)
+      line = linenum
+      break
+    }
+    pos += p.length
+    line += n
+  }
+  if line < linenum || pos >= self.length {
+    return 0, PAST_END.Err()
+  }
+  return pos, nil
+}
+
+func (self *PieceTable) GetCoordinates(pos int) (line int, col int, err error) {
+  if err := checkPosition(pos, self.length); err != nil {
+    return 0, 0, err
+  }
+  line = 1
+  i, offset := self.findPiece(pos)
+  for _, p := range self.pieces[:i] {
+    line += self.newlinesIn(p, p.length)
+  }
+  if i < len(self.pieces) {
+    line += self.newlinesIn(self.pieces[i], offset)
+  }
+  return line, self.columnOf(pos), nil
+}
+
+// Get the column of a position, by looking back for the start of its
+// line.
+func (self *PieceTable) columnOf(pos int) int {
+  i, offset := self.findPiece(pos)
+  col := 0
+  for ; i >= 0; i-- {
+    var chunk []uint8
+    if i < len(self.pieces) {
+      chunk = self.text(self.pieces[i])[:offset]
+    }
+    if nl := bytes.LastIndexByte(chunk, '\n'); nl >= 0 {
+      return col + len(chunk) - nl - 1
+    }
+    col += len(chunk)
+    if i > 0 {
+      offset = self.pieces[i-1].length
+    }
+  }
+  return col
+}
+
+func (self *PieceTable) LineCount() int {
+  count := 1
+  for _, p := range self.pieces {
+    count += self.newlinesIn(p, p.length)
+  }
+  return count
+}
@@ -21,42 +21,72 @@ package buf
 
 import (
 	"os"
+	"weak"
 )
 
+// The text of a gap buffer is held in a single array, with a gap at
+// the cursor position. The text before the cursor is in
+// data[:gap_start], and the text after it is in data[gap_end:].
+// Inserting at the cursor just fills in the start of the gap, and
+// moving the cursor moves the gap with a single block copy.
 type GapBuffer struct {
-  prechars   []uint8 
-  postchars  []uint8
-  line       int
-  column     int
-  undo_stack []UndoOperation
-  undoing    bool
-  dirty      bool
-  filename   string	
+  data         []uint8
+  gap_start    int
+  gap_end      int
+  pre_lines    []int
+  post_lines   []int
+  line         int
+  column       int
+  marks        map[string]*Mark
+  positions    []*Mark
+  selection    *Selection
+  cursors      []*Selection
+  undo_root    *UndoNode
+  undo_current *UndoNode
+  undo_nodes   []*UndoNode
+  undo_groups  []*GroupOperation
+  undoing      bool
+  dirty        bool
+  filename     string	
+  disk         diskState
+  keep_undo    bool
+  backup       BackupPolicy
+  version      int
+  version_base int
+  version_log  []versionChange
+  shared       *BufferVersion
+  versions     []weak.Pointer[BufferVersion]
+  fileFormat
+  changeNotifier
 }
 
 // Create a new gap buffer with a specified capacity.
 func NewBuffer(size int) *GapBuffer {
   result := new(GapBuffer)
-  result.prechars = make([]uint8, 0, size)
-  result.postchars = make([]uint8, 0, size)
+  result.data = make([]uint8, size)
+  result.gap_start = 0
+  result.gap_end = size
   result.line = 1
   result.column = 0
-  result.undo_stack = make([]UndoOperation, 0, 1000)
+  result.marks = make(map[string]*Mark)
+  result.selection = result.newSelection(0, 0)
+  result.resetUndo()
   result.undoing = false
   result.dirty = false
   result.filename = ""
+  result.backup = DefaultBackupPolicy
   return result
 }
 
-func NewFileBuffer(filename string) (buf *GapBuffer, result ResultCode) {
+func NewFileBuffer(filename string) (buf *GapBuffer, err error) {
   stat, err := os.Stat(filename)
   if err != nil {
 	buf = nil
-	result = IO_ERROR
+	err = ioError(err)
   } else {
 	buf = NewBuffer(int(stat.Size()) * 2)
 	buf.filename = filename
-	result = buf.Read()
+	err = buf.Read()
   }
   return
 }
@@ -67,45 +97,161 @@ func NewFileBuffer(filename string) (buf *GapBuffer, result ResultCode) {
 // editor state.
 
 func (self *GapBuffer) Clear() {
+  self.ClearCursors()
   self.MoveCursorTo(0)
-  self.Cut(int(self.Length()))
+  self.cut(int(self.Length()))
 }
 
 func (self *GapBuffer) InsertStringAt(pos int, s string) {
   self.MoveCursorTo(pos)
-  self.InsertString(s)
+  self.insertChars([]uint8(s))
 }
 
 func (self *GapBuffer) InsertCharsAt(pos int, cs []uint8) {
   self.MoveCursorTo(pos)
-  self.InsertChars(cs)
+  self.insertChars(cs)
 }
 
 ////////////////////////////////////////////////////////////////
 // Primitives used for building the stateful methods.
 
-func (self *GapBuffer) PreLength() int { return int(len(self.prechars)) }
+func (self *GapBuffer) PreLength() int { return self.gap_start }
 
-func (self *GapBuffer) PostLength() int { return int(len(self.postchars)) }
+func (self *GapBuffer) PostLength() int { return len(self.data) - self.gap_end }
 
-func (self *GapBuffer) PushPre(c uint8) { self.prechars = append(self.prechars, c) }
+func (self *GapBuffer) gapLength() int { return self.gap_end - self.gap_start }
+
+// Make sure that the gap can hold at least n more characters. When
+// the buffer has to grow, it at least doubles in size, so a series
+// of inserts takes amortized constant time per character.
+func (self *GapBuffer) ensureGap(n int) {
+  if self.gapLength() >= n {
+    return
+  }
+  size := 2 * len(self.data)
+  if size < self.Length()+n {
+    size = self.Length() + n
+  }
+  if size < 64 {
+    size = 64
+  }
+  data := make([]uint8, size)
+  copy(data, self.data[:self.gap_start])
+  post := self.PostLength()
+  copy(data[size-post:], self.data[self.gap_end:])
+  self.data = data
+  self.gap_end = size - post
+  self.shared = nil
+}
+
+// Move the gap so that it starts at pos, carrying the newline index
+// along with it. The text between the old and new gap positions is
+// moved with a single copy.
+func (self *GapBuffer) moveGap(pos int) {
+  if pos != self.gap_start {
+    self.unshare()
+  }
+  if pos < self.gap_start {
+    dist := self.gap_start - pos
+    copy(self.data[self.gap_end-dist:self.gap_end], self.data[pos:self.gap_start])
+    self.gap_start -= dist
+    self.gap_end -= dist
+    self.moveLinesToPost(pos)
+  } else if pos > self.gap_start {
+    dist := pos - self.gap_start
+    copy(self.data[self.gap_start:pos], self.data[self.gap_end:self.gap_end+dist])
+    self.gap_start += dist
+    self.gap_end += dist
+    self.moveLinesToPre(pos)
+  }
+}
+
+// Recompute the cursor line and column from the newline index.
+func (self *GapBuffer) updateLineAndColumn() {
+  self.line = len(self.pre_lines) + 1
+  if len(self.pre_lines) > 0 {
+    self.column = self.gap_start - self.pre_lines[len(self.pre_lines)-1] - 1
+  } else {
+    self.column = self.gap_start
+  }
+}
+
+// Fill the start of the gap with a block of characters.
+func (self *GapBuffer) insertAtGap(cs []uint8) {
+  self.ensureGap(len(cs))
+  self.unshare()
+  self.marksInserted(self.gap_start, len(cs))
+  copy(self.data[self.gap_start:], cs)
+  for i, c := range cs {
+    if c == '\n' {
+      self.pre_lines = append(self.pre_lines, self.gap_start+i)
+    }
+  }
+  self.gap_start += len(cs)
+  self.updateLineAndColumn()
+}
+
+// Remove n characters after the gap, by widening it.
+func (self *GapBuffer) deleteAfterGap(n int) {
+  self.marksDeleted(self.gap_start, n)
+  self.gap_end += n
+  // The deleted newlines are the ones furthest from the end.
+  post := self.PostLength()
+  for len(self.post_lines) > 0 && self.post_lines[len(self.post_lines)-1] >= post {
+    self.post_lines = self.post_lines[:len(self.post_lines)-1]
+  }
+}
+
+// Remove n characters before the gap, by widening it.
+func (self *GapBuffer) deleteBeforeGap(n int) {
+  self.gap_start -= n
+  self.marksDeleted(self.gap_start, n)
+  for len(self.pre_lines) > 0 && self.pre_lines[len(self.pre_lines)-1] >= self.gap_start {
+    self.pre_lines = self.pre_lines[:len(self.pre_lines)-1]
+  }
+  self.updateLineAndColumn()
+}
+
+func (self *GapBuffer) PushPre(c uint8) {
+  self.ensureGap(1)
+  self.unshare()
+  if c == '\n' {
+    self.pre_lines = append(self.pre_lines, self.gap_start)
+  }
+  self.data[self.gap_start] = c
+  self.gap_start++
+}
 
 func (self *GapBuffer) PopPre() (result uint8) {
   if self.PreLength() > 0 {
-    result = self.prechars[self.PreLength()-1]
-    self.prechars = self.prechars[0 : self.PreLength()-1]
+    self.gap_start--
+    result = self.data[self.gap_start]
+    if result == '\n' {
+      self.pre_lines = self.pre_lines[:len(self.pre_lines)-1]
+    }
   } else {
     result = 0
   }
   return
 }
 
-func (self *GapBuffer) PushPost(c uint8) { self.postchars = append(self.postchars, c) }
+func (self *GapBuffer) PushPost(c uint8) {
+  self.ensureGap(1)
+  self.unshare()
+  if c == '\n' {
+    self.post_lines = append(self.post_lines, self.PostLength())
+  }
+  self.gap_end--
+  self.data[self.gap_end] = c
+}
 
 func (self *GapBuffer) PopPost() (result uint8) {
   if self.PostLength() > 0 {
-    result = self.postchars[self.PostLength()-1]
-    self.postchars = self.postchars[0 : self.PostLength()-1]
+    result = self.data[self.gap_end]
+    self.gap_end++
+    if result == '\n' {
+      self.post_lines = self.post_lines[:len(self.post_lines)-1]
+    }
   } else {
     result = 0
   }
@@ -114,7 +260,7 @@ func (self *GapBuffer) PopPost() (result uint8) {
 
 func (self *GapBuffer) PeekPost() (result uint8) {
   if self.PostLength() > 0 {
-    result = self.postchars[self.PostLength()-1]
+    result = self.data[self.gap_end]
   } else {
     result = 0
   }
@@ -23,109 +23,75 @@ package buf
 // Query operations
 //
 
-func (self *GapBuffer) GetCharAt(pos int) (c uint8, success ResultCode) {
-  if pos > self.PreLength()+self.PostLength() {
+func (self *GapBuffer) GetCharAt(pos int) (c uint8, err error) {
+  if err = checkCharPosition(pos, self.Length()); err != nil {
     c = 0
-    success = PAST_END
     return
   } else {
-    success = SUCCEEDED
-    if pos < self.PreLength() {
-      c = self.prechars[pos]
+    if pos < self.gap_start {
+      c = self.data[pos]
     } else {
-      offset := pos - self.PreLength()
-      c = self.postchars[self.PostLength()-offset-1]
+      c = self.data[pos+self.gapLength()]
     }
   }
   return
 }
 
-func (self *GapBuffer) GetPositionOfLine(linenum int) (pos int, success ResultCode) {
-  linepos := 1
-  charpos := 0
-  for charpos < self.Length() && linepos < linenum {
-    charpos++
-    c, _ := self.GetCharAt(charpos) // we know that charpos is in the buffer.
-    if c == '\n' {
-      linepos++
-      charpos++ // skip past the newline The pointer should be placed
-      // *after* the newline character, so the charpos needs to be one greater -
-      // if the newline is the last character in the buffer, then this will
-      // correctly produce an error below because charpos >= self.Length()
-    }
+func (self *GapBuffer) GetPositionOfLine(linenum int) (pos int, err error) {
+  if linenum <= 1 {
+    pos = 0
+  } else if linenum-2 < self.newlineCount() {
+    pos = self.newlinePosition(linenum-2) + 1
+  } else {
+    pos = self.Length()
   }
-  if charpos >= self.Length() {
+  if pos >= self.Length() {
     // The line wasn't found
     pos = 0
-    success = PAST_END
-  } else {
-    pos = charpos
-    success = SUCCEEDED
+    err = PAST_END.Err()
   }
   return
 }
 
-func (self *GapBuffer) GetPositionOfLineAndColumn(linenum int, colnum int) (pos int, status ResultCode) {
-  lpos, l_ok := self.GetPositionOfLine(linenum)
-  if l_ok != SUCCEEDED {
+func (self *GapBuffer) GetPositionOfLineAndColumn(linenum int, colnum int) (pos int, err error) {
+  lpos, l_err := self.GetPositionOfLine(linenum)
+  if l_err != nil {
     pos = 0
-    status = INVALID_LINE
+    err = INVALID_LINE.Err()
     return
   }
   pos = lpos
-  status = SUCCEEDED
   for i := 0; i < colnum; i++ {
-    if self.PeekPost() != '\n' {
+    if c, c_err := self.GetCharAt(pos); c_err == nil && c != '\n' {
       pos++
     } else {
-      status = INVALID_COLUMN
+      err = INVALID_COLUMN.Err()
       return
     }
   }
   return
 }
 
-func (self *GapBuffer) GetRange(start int, end int) (chars []uint8, success ResultCode) {
-  if start >= self.Length() || end > self.Length() {
+func (self *GapBuffer) GetRange(start int, end int) (chars []uint8, err error) {
+  if err = checkSpan(start, end, self.Length()); err != nil {
     chars = nil
-    success = PAST_END
-    return
-  } else if start < 0 || end < 0 {
-    chars = nil
-    success = BEFORE_START
   } else {
-    chars = make([]uint8, end-start)
-    l := end - start
-    for i := 0; i < l; i++ {
-      chars[i], _ = self.GetCharAt(start + i)
-    }
-    success = SUCCEEDED
+    chars = make([]uint8, 0, end-start)
+    chars = self.appendRange(chars, start, end)
   }
   return
 }
 
-// This is a naive implementation, which is likely to be fairly slow. But slow
-// is likely to be fast enough. If it turns out to be a problem, we can easily
-// add some caching to the GapBuffer implementation to optimize it (ie, set up
-// a table of line/column locations, so that we have a starting point every 500
-// characters.
-func (self *GapBuffer) GetCoordinates(pos int) (line int, col int, success ResultCode) {
-  if pos > self.Length() {
-    col = 0
-    success = PAST_END
-  } else {
-    col = 0
-    line = 1
-    for i := 0; i < pos; i++ {
-      c, _ := self.GetCharAt(i)
-      if c == '\n' {
-        line++
-        col = 0
-      } else {
-        col++
-      }
+// Lines and columns are found using the newline index, so this
+// takes logarithmic time in the number of lines.
+func (self *GapBuffer) GetCoordinates(pos int) (line int, col int, err error) {
+  if err = checkPosition(pos, self.Length()); err == nil {
+    n := self.newlinesBefore(pos)
+    line = n + 1
+    col = pos
+    if n > 0 {
+      col = pos - self.newlinePosition(n-1) - 1
     }
-    success = SUCCEEDED
   }
   return
 }
@@ -140,23 +106,31 @@ func (self *GapBuffer) String() string { return string(self.Bytes()) }
 // of the characters before the gap, and one of the characters
 // after.
 func (self *GapBuffer) StringPair() (before string, after string) {
-  before = string(self.prechars)
-
-  after_bytes := make([]uint8, 0, self.PostLength())
-  for i := self.PostLength(); i > 0; i-- {
-    after_bytes = append(after_bytes, self.postchars[i-1])
-  }
-  after = string(after_bytes)
+  before = string(self.data[:self.gap_start])
+  after = string(self.data[self.gap_end:])
   return
 }
 
 func (self *GapBuffer) Bytes() []uint8 {
   result := make([]uint8, 0, self.Length())
-  for i := 0; i < self.PreLength();  i++ {
-    result = append(result, self.prechars[i])
+  return self.appendRange(result, 0, self.Length())
+}
+
+// Append the text between start and end to a slice. The text is
+// copied in at most two blocks, one from each side of the gap.
+func (self *GapBuffer) appendRange(result []uint8, start int, end int) []uint8 {
+  if start < self.gap_start {
+    pre_end := end
+    if pre_end > self.gap_start {
+      pre_end = self.gap_start
+    }
+    result = append(result, self.data[start:pre_end]...)
   }
-  for i := self.PostLength(); i > 0; i-- {
-    result = append(result, self.postchars[i-1])
+  if end > self.gap_start {
+    if start < self.gap_start {
+      start = self.gap_start
+    }
+    result = append(result, self.data[start+self.gapLength():end+self.gapLength()]...)
   }
   return result
 }
@@ -0,0 +1,178 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: reload.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Noticing when a buffer's file is changed by another
+//   program, and reloading it.
+//
+// When a file is read or written, the buffer records its size and
+// modification time, and a hash of its contents. The file has changed
+// if its size or time are different and its contents are too - a
+// file that's only been touched hasn't changed. Write refuses to
+// replace a file that's changed since the buffer last saw it, and
+// returns FILE_CHANGED instead.
+//
+// Reload brings the buffer up to date with the file. It only edits
+// the lines that are different, so marks and the cursor in the lines
+// that aren't stay where they are. If the buffer has edits of its
+// own, they're merged with the changes made to the file, using the
+// version of the buffer that was last read or written as the common
+// base; both sides of any conflicting change are kept, between
+// conflict markers. The reload is an ordinary edit, which can be
+// undone as a single step, and listeners see it as RELOAD_CHANGE
+// events.
+
+package buf
+
+import (
+  "bytes"
+  "fmt"
+  "os"
+  "time"
+)
+
+// What a buffer knows about its file. The buffer's text matched the
+// file at version.
+type diskState struct {
+  name    string
+  mtime   time.Time
+  size    int64
+  hash    string
+  version int
+}
+
+// Record the state of a file that has just been read or written, with
+// contents that hash to hash.
+func (self *diskState) record(filename string, hash string, version int) {
+  *self = diskState{name: saveTarget(filename), hash: hash, version: version}
+  if info, err := os.Stat(self.name); err == nil {
+    self.mtime = info.ModTime()
+    self.size = info.Size()
+  }
+}
+
+// Check whether a file has been changed since it was recorded.
+func (self *diskState) changed(filename string) (bool, error) {
+  if self.name == "" || self.name != saveTarget(filename) {
+    return false, nil
+  }
+  info, err := os.Stat(self.name)
+  if err != nil {
+    return false, ioError(err)
+  }
+  if info.ModTime().Equal(self.mtime) && info.Size() == self.size {
+    return false, nil
+  }
+  contents, err := os.ReadFile(self.name)
+  if err != nil {
+    return false, ioError(err)
+  }
+  if contentHash(contents) != self.hash {
+    return true, nil
+  }
+  self.mtime = info.ModTime()
+  self.size = info.Size()
+  return false, nil
+}
+
+// Record the state of the buffer's file, which has just been read or
+// written with the given contents.
+func (self *GapBuffer) recordDisk(contents []uint8) {
+  self.disk.record(self.filename, contentHash(contents), self.version)
+  self.trimVersions()
+}
+
+// Check whether the buffer's file has been changed since the buffer
+// last read or wrote it.
+func (self *GapBuffer) ChangedOnDisk() (bool, error) {
+  return self.disk.changed(self.filename)
+}
+
+// Write the buffer even if its file has changed on disk.
+func (self *GapBuffer) ForceWrite() error {
+  if !self.dirty {
+    return nil
+  }
+  return self.write()
+}
+
+// Update the buffer to the current contents of its file, merging in
+// its own edits if it has any. Returns the number of conflicts in
+// the merge; the buffer is clean afterwards only if it matches the
+// file.
+func (self *GapBuffer) Reload() (int, error) {
+  contents, err := os.ReadFile(self.filename)
+  if err != nil {
+    return 0, ioError(err)
+  }
+  text, err := self.decodeFile(contents)
+  if err != nil {
+    return 0, err
+  }
+  merged, conflicts := text, 0
+  if self.dirty {
+    base, err := self.VersionAt(self.disk.version)
+    if err != nil {
+      return 0, err
+    }
+    merged, conflicts = mergeText(base.Bytes(), self.Bytes(), text, "buffer", self.filename)
+  }
+
+  self.kind = RELOAD_CHANGE
+  self.BeginUndoGroup()
+  self.replaceLines(merged)
+  self.EndUndoGroup()
+  self.kind = EDIT_CHANGE
+  self.recordDisk(contents)
+  self.dirty = !bytes.Equal(merged, text)
+  return conflicts, nil
+}
+
+// Replace the text of the buffer, editing only the lines that change.
+func (self *GapBuffer) replaceLines(text []uint8) {
+  old_lines := splitLines(self.Bytes())
+  new_lines := splitLines(text)
+  old_starts := lineStarts(old_lines)
+  new_starts := lineStarts(new_lines)
+  cursor, _ := self.NewMark(self.GetCurrentPosition(), LEFT_GRAVITY)
+  hunks := diffLines(old_lines, new_lines)
+  for i := len(hunks) - 1; i >= 0; i-- {
+    h := hunks[i]
+    self.MoveCursorTo(old_starts[h.a_start])
+    if n := old_starts[h.a_end] - old_starts[h.a_start]; n > 0 {
+      self.cut(n)
+    }
+    if h.b_end > h.b_start {
+      self.insertChars(text[new_starts[h.b_start]:new_starts[h.b_end]])
+    }
+  }
+  self.MoveCursorTo(cursor.pos)
+  self.ReleaseMark(cursor)
+}
+
+// Get the position of the start of each line, and of the end of the
+// last one.
+func lineStarts(lines []string) []int {
+  starts := make([]int, len(lines)+1)
+  for i, line := range lines {
+    starts[i+1] = starts[i] + len(line)
+  }
+  return starts
+}
+
+// The error for writing over a file that's changed.
+func fileChangedError(filename string) error {
+  return fmt.Errorf("%w: %s", FILE_CHANGED.Err(), filename)
+}
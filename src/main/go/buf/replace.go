@@ -0,0 +1,126 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: replace.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Search and replace in gap buffers.
+//
+// Replacement text is built from a template, where $1 or ${name}
+// stands for the text matched by a subexpression, exactly as in
+// regexp.Expand. Each replacement call is a single undo step.
+
+package buf
+
+import (
+  "bytes"
+  "regexp"
+  "unicode"
+  "unicode/utf8"
+)
+
+type ReplaceOptions struct {
+  // Insert the template as it is, without expanding subexpressions.
+  Literal bool
+  // Make the case of each replacement follow the text it replaces:
+  // all upper case, all lower case, or capitalized.
+  PreserveCase bool
+  // The maximum number of replacements; 0 means no limit.
+  Limit int
+}
+
+// Replace every match of re. The result is the number of
+// replacements made.
+func (self *GapBuffer) ReplaceAll(re *regexp.Regexp, template string, options ReplaceOptions) int {
+  n := options.Limit
+  if n <= 0 {
+    n = -1
+  }
+  matches := self.FindAll(re, n)
+  if len(matches) == 0 {
+    return 0
+  }
+  // Replacing from the end backwards leaves the positions of the
+  // matches that haven't been replaced yet unchanged.
+  cursor, _ := self.NewMark(self.GetCurrentPosition(), LEFT_GRAVITY)
+  self.BeginUndoGroup()
+  for i := len(matches) - 1; i >= 0; i-- {
+    self.replaceMatch(re, matches[i], template, options)
+  }
+  self.EndUndoGroup()
+  self.MoveCursorTo(cursor.Position())
+  self.ReleaseMark(cursor)
+  return len(matches)
+}
+
+// Replace the first match of re at or after from, and leave the
+// cursor after the replacement. The result is the span of the
+// replacement text, so that a caller can continue from its end.
+func (self *GapBuffer) ReplaceNext(re *regexp.Regexp, template string, from int,
+  options ReplaceOptions) (Span, error) {
+  match, err := self.FindForward(re, from)
+  if err != nil {
+    return Span{}, err
+  }
+  self.BeginUndoGroup()
+  end := self.replaceMatch(re, match, template, options)
+  self.EndUndoGroup()
+  return Span{match.Start, end}, nil
+}
+
+// Replace the text of a match, returning the end of the replacement.
+func (self *GapBuffer) replaceMatch(re *regexp.Regexp, match *Match, template string,
+  options ReplaceOptions) int {
+  matched, _ := self.GetRange(match.Start, match.End)
+  var replacement []uint8
+  if options.Literal {
+    replacement = []uint8(template)
+  } else {
+    loc := make([]int, 0, 2*len(match.Groups))
+    for _, g := range match.Groups {
+      if g.Start < 0 {
+        loc = append(loc, -1, -1)
+      } else {
+        loc = append(loc, g.Start-match.Start, g.End-match.Start)
+      }
+    }
+    replacement = re.Expand(nil, []uint8(template), matched, loc)
+  }
+  if options.PreserveCase {
+    replacement = matchCase(replacement, matched)
+  }
+  self.MoveCursorTo(match.Start)
+  self.cut(len(matched))
+  self.insertChars(replacement)
+  return match.Start + len(replacement)
+}
+
+// Change the case of a replacement to follow the text it replaces.
+// Text that's neither all upper case, all lower case, nor capitalized
+// leaves the replacement alone.
+func matchCase(replacement []uint8, matched []uint8) []uint8 {
+  upper, lower := bytes.ToUpper(matched), bytes.ToLower(matched)
+  if bytes.Equal(upper, lower) || len(replacement) == 0 {
+    return replacement
+  } else if bytes.Equal(matched, upper) {
+    return bytes.ToUpper(replacement)
+  } else if bytes.Equal(matched, lower) {
+    return bytes.ToLower(replacement)
+  }
+  first, size := utf8.DecodeRune(matched)
+  if rest := matched[size:]; unicode.IsUpper(first) && bytes.Equal(rest, bytes.ToLower(rest)) {
+    r, size := utf8.DecodeRune(replacement)
+    return append([]uint8(string(unicode.ToUpper(r))), bytes.ToLower(replacement[size:])...)
+  }
+  return replacement
+}
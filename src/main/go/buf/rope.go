@@ -0,0 +1,550 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: rope.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: A rope implementation of EditBuffer, for very large files.
+//
+// The rope is a height-balanced (AVL) binary tree whose leaves hold
+// chunks of text. Each node caches the length and the number of
+// newlines beneath it, so finding a character, a line, or the line
+// containing a position all take logarithmic time. Nodes are never
+// modified once they're built: an edit splits the tree and joins the
+// pieces back together, sharing every untouched subtree with the old
+// version. That makes undo a matter of keeping the old root around.
+
+package buf
+
+import (
+  "bytes"
+  "os"
+)
+
+// The largest leaf that the rope will create by merging neighbours.
+const ropeLeafSize = 1024
+
+// Files at least this large are opened as ropes by OpenFileBuffer.
+var RopeThreshold int64 = 64 * 1024 * 1024
+
+type ropeNode struct {
+  left   *ropeNode
+  right  *ropeNode
+  leaf   []uint8
+  length int
+  lines  int
+  height int
+}
+
+// The state before and after an edit.
+type ropeEdit struct {
+  before   *ropeNode
+  after    *ropeNode
+  pos      int
+  cursor   int
+  deleted  []uint8
+  inserted []uint8
+}
+
+type Rope struct {
+  root       *ropeNode
+  cursor     int
+  line       int
+  column     int
+  undo_stack []*ropeEdit
+  redo_stack []*ropeEdit
+  dirty      bool
+  filename   string
+  disk       diskState
+  backup     BackupPolicy
+  fileFormat
+  changeNotifier
+}
+
+// Create a new, empty, rope.
+func NewRope() *Rope {
+  result := new(Rope)
+  result.root = ropeBuild(nil)
+  result.line = 1
+  result.undo_stack = make([]*ropeEdit, 0, 100)
+  result.redo_stack = make([]*ropeEdit, 0, 100)
+  result.backup = DefaultBackupPolicy
+  return result
+}
+
+// Create a rope holding the contents of a file. Unless the file has
+// to be decoded, the leaves of the rope share the storage of the file
+// contents, so the file is only held in memory once.
+func NewRopeFile(filename string) (buf *Rope, err error) {
+  buf = NewRope()
+  buf.filename = filename
+  if err = buf.Read(); err != nil {
+    return nil, err
+  }
+  return buf, nil
+}
+
+// Open a file using the buffer implementation best suited to its
+// size: a gap buffer for ordinary files, and a rope for files of
+// RopeThreshold bytes or more.
+func OpenFileBuffer(filename string) (FileBuffer, error) {
+  stat, err := os.Stat(filename)
+  if err != nil {
+    return nil, ioError(err)
+  }
+  // A nil buffer has to be returned as a nil interface, not as an
+  // interface holding a nil pointer.
+  if stat.Size() >= RopeThreshold {
+    r, err := NewRopeFile(filename)
+    if err != nil {
+      return nil, err
+    }
+    return r, nil
+  }
+  g, err := NewFileBuffer(filename)
+  if err != nil {
+    return nil, err
+  }
+  return g, nil
+}
+
+////////////////////////////////////////////////////////////////
+// Rope nodes.
+
+func ropeLeaf(chars []uint8) *ropeNode {
+  return &ropeNode{nil, nil, chars, len(chars), bytes.Count(chars, []uint8{'\n'}), 0}
+}
+
+func ropeConcat(l *ropeNode, r *ropeNode) *ropeNode {
+  height := l.height
+  if r.height > height {
+    height = r.height
+  }
+  return &ropeNode{l, r, nil, l.length + r.length, l.lines + r.lines, height + 1}
+}
+
+// Build a perfectly balanced rope from a block of text.
+func ropeBuild(chars []uint8) *ropeNode {
+  if len(chars) <= ropeLeafSize {
+    return ropeLeaf(chars)
+  }
+  mid := (len(chars) / ropeLeafSize / 2) * ropeLeafSize
+  if mid == 0 {
+    mid = ropeLeafSize
+  }
+  return ropeConcat(ropeBuild(chars[:mid]), ropeBuild(chars[mid:]))
+}
+
+func (self *ropeNode) isLeaf() bool { return self.left == nil }
+
+func ropeRotateLeft(n *ropeNode) *ropeNode {
+  return ropeConcat(ropeConcat(n.left, n.right.left), n.right.right)
+}
+
+func ropeRotateRight(n *ropeNode) *ropeNode {
+  return ropeConcat(n.left.left, ropeConcat(n.left.right, n.right))
+}
+
+// Restore the AVL property at a node whose children differ in
+// height by at most two.
+func ropeBalance(n *ropeNode) *ropeNode {
+  if n.isLeaf() {
+    return n
+  }
+  diff := n.left.height - n.right.height
+  if diff > 1 {
+    if !n.left.isLeaf() && n.left.left.height < n.left.right.height {
+      n = ropeConcat(ropeRotateLeft(n.left), n.right)
+    }
+    return ropeRotateRight(n)
+  } else if diff < -1 {
+    if !n.right.isLeaf() && n.right.right.height < n.right.left.height {
+      n = ropeConcat(n.left, ropeRotateRight(n.right))
+    }
+    return ropeRotateLeft(n)
+  }
+  return n
+}
+
+// Join two ropes, keeping the result balanced. Small adjacent leaves
+// are merged, so that repeated small edits don't leave the rope full
+// of tiny leaves.
+func ropeJoin(l *ropeNode, r *ropeNode) *ropeNode {
+  if l.length == 0 {
+    return r
+  } else if r.length == 0 {
+    return l
+  }
+  if l.height > r.height+1 {
+    return ropeBalance(ropeConcat(l.left, ropeJoin(l.right, r)))
+  } else if r.height > l.height+1 {
+    return ropeBalance(ropeConcat(ropeJoin(l, r.left), r.right))
+  }
+  if l.isLeaf() && r.isLeaf() && l.length+r.length <= ropeLeafSize {
+    merged := make([]uint8, 0, l.length+r.length)
+    merged = append(append(merged, l.leaf...), r.leaf...)
+    return ropeLeaf(merged)
+  }
+  return ropeConcat(l, r)
+}
+
+// Split a rope into the text before pos and the text after it.
+func ropeSplit(n *ropeNode, pos int) (*ropeNode, *ropeNode) {
+  if n.isLeaf() {
+    return ropeLeaf(n.leaf[:pos]), ropeLeaf(n.leaf[pos:])
+  }
+  if pos < n.left.length {
+    l, r := ropeSplit(n.left, pos)
+    return l, ropeJoin(r, n.right)
+  } else if pos > n.left.length {
+    l, r := ropeSplit(n.right, pos-n.left.length)
+    return ropeJoin(n.left, l), r
+  }
+  return n.left, n.right
+}
+
+func (self *ropeNode) charAt(pos int) uint8 {
+  for !self.isLeaf() {
+    if pos < self.left.length {
+      self = self.left
+    } else {
+      pos -= self.left.length
+      self = self.right
+    }
+  }
+  return self.leaf[pos]
+}
+
+// The number of newlines before pos.
+func (self *ropeNode) newlinesBefore(pos int) int {
+  count := 0
+  for !self.isLeaf() {
+    if pos < self.left.length {
+      self = self.left
+    } else {
+      pos -= self.left.length
+      count += self.left.lines
+      self = self.right
+    }
+  }
+  return count + bytes.Count(self.leaf[:pos], []uint8{'\n'})
+}
+
+// The position of the n'th newline, counting from 0.
+func (self *ropeNode) newlinePosition(n int) int {
+  pos := 0
+  for !self.isLeaf() {
+    if n < self.left.lines {
+      self = self.left
+    } else {
+      n -= self.left.lines
+      pos += self.left.length
+      self = self.right
+    }
+  }
+  for i, c := range self.leaf {
+    if c == '\n' {
+      if n == 0 {
+        return pos + i
+      }
+      n--
+    }
+  }
+  return pos + self.length
+}
+
+// Call f on each chunk of text between start and end, in order.
+func (self *ropeNode) each(start int, end int, f func(chunk []uint8)) {
+  if start >= end {
+    return
+  }
+  if self.isLeaf() {
+    f(self.leaf[start:end])
+    return
+  }
+  if start < self.left.length {
+    e := end
+    if e > self.left.length {
+      e = self.left.length
+    }
+    self.left.each(start, e, f)
+  }
+  if end > self.left.length {
+    s := start - self.left.length
+    if s < 0 {
+      s = 0
+    }
+    self.right.each(s, end-self.left.length, f)
+  }
+}
+
+////////////////////////////////////////////////////////////////
+// Primitives.
+
+// Replace n characters starting at pos with chars, returning the
+// characters that were removed.
+func (self *Rope) splice(pos int, n int, chars []uint8, cursor int) []uint8 {
+  before := self.root
+  l, rest := ropeSplit(self.root, pos)
+  mid, r := ropeSplit(rest, n)
+  removed := make([]uint8, 0, mid.length)
+  mid.each(0, mid.length, func(chunk []uint8) { removed = append(removed, chunk...) })
+  inserted := make([]uint8, len(chars))
+  copy(inserted, chars)
+  self.root = ropeJoin(ropeJoin(l, ropeBuild(inserted)), r)
+  self.undo_stack = append(self.undo_stack, &ropeEdit{before, self.root, pos, cursor, removed, inserted})
+  self.redo_stack = self.redo_stack[:0]
+  self.dirty = true
+  self.changed(pos, self.root.newlinesBefore(pos)+1, removed, inserted)
+  return removed
+}
+
+func (self *Rope) setCursor(pos int) {
+  self.cursor = pos
+  self.line, self.column, _ = self.GetCoordinates(pos)
+}
+
+////////////////////////////////////////////////////////////////
+// Stateless methods.
+
+func (self *Rope) Length() int { return self.root.length }
+
+func (self *Rope) Clear() {
+  self.MoveCursorTo(0)
+  self.Cut(self.Length())
+}
+
+func (self *Rope) GetCharAt(pos int) (uint8, error) {
+  if err := checkCharPosition(pos, self.root.length); err != nil {
+    return 0, err
+  }
+  return self.root.charAt(pos), nil
+}
+
+func (self *Rope) GetRange(start int, end int) ([]uint8, error) {
+  if err := checkSpan(start, end, self.root.length); err != nil {
+    return nil, err
+  }
+  result := make([]uint8, 0, end-start)
+  self.root.each(start, end, func(chunk []uint8) { result = append(result, chunk...) })
+  return result, nil
+}
+
+func (self *Rope) Bytes() []uint8 {
+  result := make([]uint8, 0, self.root.length)
+  self.root.each(0, self.root.length, func(chunk []uint8) { result = append(result, chunk...) })
+  return result
+}
+
+func (self *Rope) String() string { return string(self.Bytes()) }
+
+// For debugging purposes: return the text before and after the cursor.
+func (self *Rope) StringPair() (before string, after string) {
+  all := self.Bytes()
+  return string(all[:self.cursor]), string(all[self.cursor:])
+}
+
+func (self *Rope) IsDirty() bool { return self.dirty }
+
+func (self *Rope) GetFilename() string { return self.filename }
+
+func (self *Rope) GetPositionOfLine(linenum int) (pos int, err error) {
+  if linenum <= 1 {
+    pos = 0
+  } else if linenum-2 < self.root.lines {
+    pos = self.root.newlinePosition(linenum-2) + 1
+  } else {
+    pos = self.root.length
+  }
+  if pos >= self.root.length {
+    return 0, PAST_END.Err()
+  }
+  return pos, nil
+}
+
+func (self *Rope) GetPositionOfLineAndColumn(linenum int, colnum int) (pos int, err error) {
+  pos, err = self.GetPositionOfLine(linenum)
+  if err != nil {
+    return 0, INVALID_LINE.Err()
+  }
+  for i := 0; i < colnum; i++ {
+    if c, ok := self.GetCharAt(pos); ok == nil && c != '\n' {
+      pos++
+    } else {
+      return pos, INVALID_COLUMN.Err()
+    }
+  }
+  return pos, nil
+}
+
+func (self *Rope) GetCoordinates(pos int) (line int, col int, err error) {
+  if err := checkPosition(pos, self.root.length); err != nil {
+    return 0, 0, err
+  }
+  n := self.root.newlinesBefore(pos)
+  col = pos
+  if n > 0 {
+    col = pos - self.root.newlinePosition(n-1) - 1
+  }
+  return n + 1, col, nil
+}
+
+func (self *Rope) LineCount() int { return self.root.lines + 1 }
+
+////////////////////////////////////////////////////////////////
+// Cursor-based methods.
+
+func (self *Rope) MoveCursorTo(pos int) {
+  if pos < 0 {
+    pos = 0
+  } else if pos > self.root.length {
+    pos = self.root.length
+  }
+  self.setCursor(pos)
+}
+
+func (self *Rope) MoveToLine(linenum int) {
+  pos, err := self.GetPositionOfLine(linenum)
+  if err != nil && linenum > 1 {
+    pos = self.root.length
+  }
+  self.MoveCursorTo(pos)
+}
+
+func (self *Rope) MoveCursorBy(distance int) {
+  self.MoveCursorTo(self.cursor + distance)
+}
+
+func (self *Rope) StepCursorForward() error {
+  c, err := self.GetCharAt(self.cursor)
+  if err != nil {
+    return err
+  }
+  self.cursor++
+  if c == '\n' {
+    self.line++
+    self.column = 0
+  } else {
+    self.column++
+  }
+  return nil
+}
+
+func (self *Rope) StepCursorBackward() error {
+  if self.cursor == 0 {
+    return checkPosition(-1, self.Length())
+  }
+  if c, _ := self.GetCharAt(self.cursor - 1); c == '\n' {
+    self.setCursor(self.cursor - 1)
+  } else {
+    self.cursor--
+    self.column--
+  }
+  return nil
+}
+
+func (self *Rope) GetCurrentPosition() int { return self.cursor }
+
+func (self *Rope) GetCurrentLine() int { return self.line }
+
+func (self *Rope) GetCurrentColumn() int { return self.column }
+
+func (self *Rope) InsertChar(c uint8) {
+  self.InsertChars([]uint8{c})
+}
+
+func (self *Rope) InsertChars(cs []uint8) {
+  if len(cs) == 0 {
+    return
+  }
+  self.splice(self.cursor, 0, cs, self.cursor+len(cs))
+  self.setCursor(self.cursor + len(cs))
+}
+
+func (self *Rope) InsertString(s string) {
+  self.InsertChars([]uint8(s))
+}
+
+func (self *Rope) Cut(numChars int) []uint8 {
+  start, end := self.cursor, self.cursor+numChars
+  if numChars < 0 {
+    start, end = self.cursor+numChars, self.cursor
+  }
+  if start < 0 {
+    start = 0
+  }
+  if end > self.root.length {
+    end = self.root.length
+  }
+  if end <= start {
+    return []uint8{}
+  }
+  cutbuf := self.splice(start, end-start, nil, start)
+  self.setCursor(start)
+  return cutbuf
+}
+
+func (self *Rope) Copy(numChars int) []uint8 {
+  start, end := self.cursor, self.cursor+numChars
+  if numChars < 0 {
+    start, end = self.cursor+numChars, self.cursor
+  }
+  if start < 0 {
+    start = 0
+  }
+  if end > self.root.length {
+    end = self.root.length
+  }
+  copybuf := make([]uint8, 0, end-start)
+  self.root.each(start, end, func(chunk []uint8) { copybuf = append(copybuf, chunk...) })
+  return copybuf
+}
+
+////////////////////////////////////////////////////////////////
+// Undo and redo just switch between saved roots.
+
+func (self *Rope) Undo() error {
+  if !self.CanUndo() {
+    return INVALID.Err()
+  }
+  edit := self.undo_stack[len(self.undo_stack)-1]
+  self.undo_stack = self.undo_stack[:len(self.undo_stack)-1]
+  self.root = edit.before
+  self.redo_stack = append(self.redo_stack, edit)
+  self.dirty = true
+  self.setCursor(edit.pos)
+  self.kind = UNDO_CHANGE
+  self.changed(edit.pos, self.root.newlinesBefore(edit.pos)+1, edit.inserted, edit.deleted)
+  self.kind = EDIT_CHANGE
+  return nil
+}
+
+func (self *Rope) Redo() error {
+  if !self.CanRedo() {
+    return INVALID.Err()
+  }
+  edit := self.redo_stack[len(self.redo_stack)-1]
+  self.redo_stack = self.redo_stack[:len(self.redo_stack)-1]
+  self.root = edit.after
+  self.undo_stack = append(self.undo_stack, edit)
+  self.dirty = true
+  self.setCursor(edit.cursor)
+  self.kind = REDO_CHANGE
+  self.changed(edit.pos, self.root.newlinesBefore(edit.pos)+1, edit.deleted, edit.inserted)
+  self.kind = EDIT_CHANGE
+  return nil
+}
+
+func (self *Rope) CanUndo() bool { return len(self.undo_stack) > 0 }
+
+func (self *Rope) CanRedo() bool { return len(self.redo_stack) > 0 }
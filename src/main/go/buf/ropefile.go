@@ -0,0 +1,115 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// File: ropefile.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Reading and writing the files of ropes.
+//
+// Ropes are saved the same way as gap buffers: they keep the file's
+// encoding and line endings, write it atomically, make backups, and
+// refuse to write over a file that's changed since they last saw it.
+// A rope whose text is written as it is - UTF-8 without a byte order
+// mark, with "\n" or mixed line endings - is streamed to the file a
+// leaf at a time, so saving a huge file doesn't need a second copy
+// of it in memory.
+
+package buf
+
+import (
+  "io"
+  "os"
+)
+
+func (self *Rope) SetBackupPolicy(policy BackupPolicy) { self.backup = policy }
+
+func (self *Rope) GetBackupPolicy() BackupPolicy { return self.backup }
+
+// Replace the text of the rope with the contents of its file. This
+// can't be undone.
+func (self *Rope) Read() error {
+  contents, err := os.ReadFile(self.filename)
+  if err != nil {
+    return ioError(err)
+  }
+  text, err := self.decodeFile(contents)
+  if err != nil {
+    return err
+  }
+  var old []uint8
+  if self.listening() {
+    old = self.Bytes()
+  }
+  self.root = ropeBuild(text)
+  self.undo_stack = self.undo_stack[:0]
+  self.redo_stack = self.redo_stack[:0]
+  self.setCursor(min(self.cursor, self.root.length))
+  self.kind = RELOAD_CHANGE
+  self.changed(0, 1, old, text)
+  self.kind = EDIT_CHANGE
+  self.disk.record(self.filename, contentHash(contents), 0)
+  self.dirty = false
+  return nil
+}
+
+// Check whether the rope's file has been changed since the rope last
+// read or wrote it.
+func (self *Rope) ChangedOnDisk() (bool, error) {
+  return self.disk.changed(self.filename)
+}
+
+// Save the rope to its file. If the file has changed since the rope
+// last read or wrote it, this returns FILE_CHANGED instead.
+func (self *Rope) Write() error {
+  if !self.dirty {
+    return nil
+  }
+  if changed, _ := self.ChangedOnDisk(); changed {
+    return fileChangedError(self.filename)
+  }
+  return self.write()
+}
+
+// Write the rope even if its file has changed on disk.
+func (self *Rope) ForceWrite() error {
+  if !self.dirty {
+    return nil
+  }
+  return self.write()
+}
+
+func (self *Rope) write() error {
+  var write func(io.Writer) error
+  var hash func() string
+  if self.isVerbatim() {
+    write, hash = writeChunks(func(f func(chunk []uint8)) { self.root.each(0, self.root.length, f) })
+  } else {
+    bytes, err := self.encodeFile(self.Bytes())
+    if err != nil {
+      return err
+    }
+    write = writeData(bytes)
+    hash = func() string { return contentHash(bytes) }
+  }
+  filename := saveTarget(self.filename)
+  if err := self.backup.backup(filename); err != nil {
+    return ioError(err)
+  }
+  if err := writeFileStream(filename, write); err != nil {
+    return err
+  }
+  self.dirty = false
+  self.disk.record(self.filename, hash(), 0)
+  return nil
+}
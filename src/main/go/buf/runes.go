@@ -0,0 +1,163 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: runes.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: UTF-8 aware access to buffers. Positions in the buffer
+//   are always byte offsets; these methods make it possible to step
+//   over whole characters, and to report columns in runes or in
+//   graphemes (user-perceived characters) instead of bytes.
+
+package buf
+
+import (
+  "unicode"
+  "unicode/utf8"
+)
+
+// Get the rune that starts at a byte position, along with its length
+// in bytes. If pos isn't at the start of a valid UTF-8 sequence, the
+// result is utf8.RuneError with a size of 1.
+func (self *GapBuffer) GetRuneAt(pos int) (r rune, size int, err error) {
+  if err := checkCharPosition(pos, self.Length()); err != nil {
+    return utf8.RuneError, 0, err
+  }
+  var bytes [utf8.UTFMax]uint8
+  n := 0
+  for n < utf8.UTFMax && pos+n < self.Length() {
+    bytes[n], _ = self.GetCharAt(pos + n)
+    n++
+  }
+  r, size = utf8.DecodeRune(bytes[:n])
+  return r, size, nil
+}
+
+// Move the cursor forward by one rune.
+func (self *GapBuffer) StepRuneForward() error {
+  _, size, err := self.GetRuneAt(self.GetCurrentPosition())
+  if err != nil {
+    return err
+  }
+  for i := 0; i < size; i++ {
+    self.stepCursorForward()
+  }
+  return nil
+}
+
+// Move the cursor backward by one rune. If the bytes before the
+// cursor aren't valid UTF-8, this steps back by a single byte.
+func (self *GapBuffer) StepRuneBackward() error {
+  pos := self.GetCurrentPosition()
+  if pos == 0 {
+    return checkPosition(-1, self.Length())
+  }
+  start := pos - 1
+  for start > 0 && pos-start < utf8.UTFMax && !utf8.RuneStart(self.data[start]) {
+    start--
+  }
+  r, size := utf8.DecodeRune(self.data[start:pos])
+  if (r == utf8.RuneError && size == 1) || start+size != pos {
+    start = pos - 1
+  }
+  self.MoveCursorTo(start)
+  return nil
+}
+
+// Get the line and column of a position, with the column counted
+// in runes.
+func (self *GapBuffer) GetRuneCoordinates(pos int) (line int, col int, err error) {
+  line, col, err = self.GetCoordinates(pos)
+  if err == nil {
+    col = utf8.RuneCount(self.getLinePrefix(pos, col))
+  }
+  return
+}
+
+// Get the line and column of a position, with the column counted
+// in graphemes.
+func (self *GapBuffer) GetGraphemeCoordinates(pos int) (line int, col int, err error) {
+  line, col, err = self.GetCoordinates(pos)
+  if err == nil {
+    col = GraphemeCount(self.getLinePrefix(pos, col))
+  }
+  return
+}
+
+func (self *GapBuffer) GetCurrentRuneColumn() int {
+  return utf8.RuneCount(self.data[self.gap_start-self.column : self.gap_start])
+}
+
+func (self *GapBuffer) GetCurrentGraphemeColumn() int {
+  return GraphemeCount(self.data[self.gap_start-self.column : self.gap_start])
+}
+
+// Get the text between the start of a line and a position on
+// that line, where col is the byte column of the position.
+func (self *GapBuffer) getLinePrefix(pos int, col int) []uint8 {
+  if col == 0 {
+    return nil
+  }
+  prefix, _ := self.GetRange(pos-col, pos)
+  return prefix
+}
+
+// Count the graphemes in a UTF-8 string. This is an approximation of
+// the Unicode extended grapheme cluster rules which handles the cases
+// that turn up in source code: combining marks, variation selectors,
+// emoji modifiers, zero-width-joiner sequences, flag pairs, and CRLF.
+func GraphemeCount(bytes []uint8) int {
+  count := 0
+  prev := rune(-1)
+  regional := 0
+  for len(bytes) > 0 {
+    r, size := utf8.DecodeRune(bytes)
+    bytes = bytes[size:]
+    if prev == -1 || !extendsGrapheme(prev, r, regional) {
+      count++
+    }
+    if isRegionalIndicator(r) {
+      regional++
+    } else {
+      regional = 0
+    }
+    prev = r
+  }
+  return count
+}
+
+// Decide whether r continues the grapheme that ends with prev.
+// regional is the number of regional indicators immediately before r.
+func extendsGrapheme(prev rune, r rune, regional int) bool {
+  switch {
+  case prev == '\r' && r == '\n':
+    return true
+  case prev == '\u200d':
+    return !unicode.IsControl(r)
+  case r == '\u200d':
+    return true
+  case unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc):
+    return true
+  case r >= 0xfe00 && r <= 0xfe0f, r >= 0xe0100 && r <= 0xe01ef:
+    // variation selectors
+    return true
+  case r >= 0x1f3fb && r <= 0x1f3ff:
+    // emoji skin tone modifiers
+    return true
+  case isRegionalIndicator(r):
+    return regional%2 == 1
+  }
+  return false
+}
+
+func isRegionalIndicator(r rune) bool { return r >= 0x1f1e6 && r <= 0x1f1ff }
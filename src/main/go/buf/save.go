@@ -0,0 +1,176 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: save.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Saving files safely.
+//
+// A file is never written in place. The new contents go into a
+// temporary file in the same directory, which is synced to disk and
+// then renamed over the original, so a crash part way through a save
+// leaves either the old file or the new one, and never a truncated
+// mix of the two. The temporary file is given the mode (and, where
+// the system allows it, the owner) of the file it replaces, including
+// its setuid, setgid and sticky bits. If the name is a symbolic link,
+// the file it points to is replaced, and the link is left alone.
+
+package buf
+
+import (
+  "bufio"
+  "crypto/sha256"
+  "encoding/hex"
+  "io"
+  "os"
+  "path/filepath"
+)
+
+// The mode for files that don't exist yet.
+const newFileMode os.FileMode = 0644
+
+// The bits of a file's mode that a save keeps: its permissions, and
+// the setuid, setgid and sticky bits.
+const savedModeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Replace the contents of a file. Any error is returned wrapped in
+// IO_ERROR.
+func writeFileAtomic(filename string, data []uint8) error {
+  return writeFileStream(filename, writeData(data))
+}
+
+// Replace the contents of a file with whatever write produces, without
+// having to hold it all in memory.
+func writeFileStream(filename string, write func(io.Writer) error) error {
+  filename = saveTarget(filename)
+  info, err := os.Stat(filename)
+  if os.IsNotExist(err) {
+    return replaceFile(filename, write, newFileMode, nil)
+  } else if err != nil {
+    return ioError(err)
+  }
+  return replaceFile(filename, write, info.Mode()&savedModeBits, info)
+}
+
+func writeData(data []uint8) func(io.Writer) error {
+  return func(w io.Writer) error {
+    _, err := w.Write(data)
+    return err
+  }
+}
+
+// Make a function for writeFileStream that writes the chunks of text
+// that each produces, hashing them as it goes. Once the file has been
+// written, hash gives the hash of its contents.
+func writeChunks(each func(f func(chunk []uint8))) (write func(io.Writer) error, hash func() string) {
+  h := sha256.New()
+  write = func(w io.Writer) error {
+    out := bufio.NewWriter(io.MultiWriter(w, h))
+    each(func(chunk []uint8) { out.Write(chunk) })
+    return out.Flush()
+  }
+  hash = func() string { return hex.EncodeToString(h.Sum(nil)) }
+  return write, hash
+}
+
+// Replace the contents of a file that belongs with another file, like
+// an undo file. It gets the other file's permissions, except that it
+// isn't executable, and the other file's owner, since it can hold
+// anything that the other file ever did.
+func writeCompanionFile(filename string, data []uint8, source string) error {
+  info, err := os.Stat(saveTarget(source))
+  if err != nil {
+    return ioError(err)
+  }
+  return replaceFile(saveTarget(filename), writeData(data), info.Mode().Perm()&^0111, info)
+}
+
+// Atomically replace a file with one that has the given mode, and the
+// owner of the file described by owner, if it isn't nil.
+func replaceFile(filename string, write func(io.Writer) error, mode os.FileMode, owner os.FileInfo) error {
+  dir, base := filepath.Split(filename)
+  if dir == "" {
+    dir = "."
+  }
+  tmp, err := os.CreateTemp(dir, "."+base+".tmp*")
+  if err != nil {
+    return ioError(err)
+  }
+  if err = writeTempFile(tmp, write, mode, owner); err != nil {
+    os.Remove(tmp.Name())
+    return ioError(err)
+  }
+  if err = os.Rename(tmp.Name(), filename); err != nil {
+    os.Remove(tmp.Name())
+    return ioError(err)
+  }
+  if err = syncDir(dir); err != nil {
+    return ioError(err)
+  }
+  return nil
+}
+
+// Get the name of the file that's really written when saving to
+// filename: the target of a symbolic link, or else filename itself.
+func saveTarget(filename string) string {
+  if target, err := filepath.EvalSymlinks(filename); err == nil {
+    return target
+  }
+  return filename
+}
+
+// Fill in a new temporary file, give it its mode and owner, and close
+// it.
+func writeTempFile(tmp *os.File, write func(io.Writer) error, mode os.FileMode, owner os.FileInfo) error {
+  err := write(tmp)
+  if err == nil {
+    err = tmp.Sync()
+  }
+  if err == nil && owner != nil {
+    err = chownLike(tmp, owner)
+  }
+  if err == nil {
+    err = tmp.Chmod(mode)
+  }
+  if close_err := tmp.Close(); err == nil {
+    err = close_err
+  }
+  return err
+}
+
+// Copy a file, for file systems that can't link it. The copy gets the
+// permissions of the original, just as a link would, and gets them
+// before anything is written to it.
+func copyFile(from string, to string) error {
+  in, err := os.Open(from)
+  if err != nil {
+    return err
+  }
+  defer in.Close()
+  info, err := in.Stat()
+  if err != nil {
+    return err
+  }
+  out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+  if err != nil {
+    return err
+  }
+  err = out.Chmod(info.Mode().Perm())
+  if err == nil {
+    _, err = io.Copy(out, in)
+  }
+  if close_err := out.Close(); err == nil {
+    err = close_err
+  }
+  return err
+}
@@ -0,0 +1,35 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: save_other.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Saving files on systems without Unix ownership. Files
+//   keep their mode, but there's no owner to copy, and directories
+//   can't be synced.
+
+//go:build !unix
+
+package buf
+
+import (
+  "os"
+)
+
+func chownLike(file *os.File, info os.FileInfo) error {
+  return nil
+}
+
+func syncDir(dir string) error {
+  return nil
+}
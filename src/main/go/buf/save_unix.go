@@ -0,0 +1,55 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: save_unix.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: The Unix parts of saving files.
+
+//go:build unix
+
+package buf
+
+import (
+  "errors"
+  "os"
+  "syscall"
+)
+
+// Give a file the owner and group of another. Only root can give a
+// file away, so a permission error just leaves the file owned by
+// whoever is saving it, like any other editor would.
+func chownLike(file *os.File, info os.FileInfo) error {
+  stat, ok := info.Sys().(*syscall.Stat_t)
+  if !ok {
+    return nil
+  }
+  err := file.Chown(int(stat.Uid), int(stat.Gid))
+  if errors.Is(err, os.ErrPermission) {
+    return nil
+  }
+  return err
+}
+
+// Sync a directory, so that a rename in it is on disk.
+func syncDir(dir string) error {
+  d, err := os.Open(dir)
+  if err != nil {
+    return err
+  }
+  err = d.Sync()
+  if close_err := d.Close(); err == nil {
+    err = close_err
+  }
+  return err
+}
@@ -0,0 +1,212 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: search.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Regular expression search in gap buffers and piece
+//   tables.
+//
+// The regexp package can match against an io.RuneReader, so searches
+// read the buffer a rune at a time, straight out of its storage - the
+// array on either side of the gap, or the pieces of a piece table -
+// instead of copying the text first.
+//
+// A reader only sees the text from where it starts, so a search that
+// starts in the middle of the buffer would treat its starting point
+// as the beginning of the text, and "^" and "\b" would match there.
+// To give them the right context, the search starts one rune earlier,
+// with a pattern that first matches that rune and then the original
+// expression: the leftmost match of the combined pattern is the
+// leftmost match of the original at or after the starting point.
+// Every assertion in the regexp package looks at most one rune back,
+// so one rune of context is enough.
+
+package buf
+
+import (
+  "io"
+  "regexp"
+  "unicode/utf8"
+)
+
+// A span of the buffer, from Start up to (but not including) End.
+type Span struct {
+  Start int
+  End   int
+}
+
+// A match of a regular expression. Groups[i] is the span matched by
+// subexpression i, with Groups[0] being the whole match; a
+// subexpression that didn't take part in the match has a span of
+// {-1, -1}.
+type Match struct {
+  Start  int
+  End    int
+  Groups []Span
+}
+
+// What a buffer has to provide to be searched.
+type searchable interface {
+  Length() int
+  GetRange(start int, end int) ([]uint8, error)
+  GetRuneAt(pos int) (rune, int, error)
+  // Get a reader for the runes of the buffer starting at pos.
+  runesFrom(pos int) io.RuneReader
+}
+
+func (self *GapBuffer) runesFrom(pos int) io.RuneReader { return &Reader{self, pos, -1} }
+
+// Find the first match of re that starts at or after from.
+func (self *GapBuffer) FindForward(re *regexp.Regexp, from int) (*Match, error) {
+  return findForward(self, re, from)
+}
+
+// Find the last match of re that starts before from. The candidates
+// are the matches that FindAll would find, so a match that overlaps
+// the end of an earlier one isn't considered.
+func (self *GapBuffer) FindBackward(re *regexp.Regexp, from int) (*Match, error) {
+  return findBackward(self, re, from)
+}
+
+// Find the successive, non-overlapping, matches of re in the buffer.
+// If n >= 0, at most n matches are returned. As with the regexp
+// package, an empty match right after a previous match is ignored.
+func (self *GapBuffer) FindAll(re *regexp.Regexp, n int) []*Match {
+  return findAll(self, re, n)
+}
+
+// Find the first match of re that starts at or after from.
+func (self *PieceTable) FindForward(re *regexp.Regexp, from int) (*Match, error) {
+  return findForward(self, re, from)
+}
+
+// Find the last match of re that starts before from, as
+// GapBuffer.FindBackward.
+func (self *PieceTable) FindBackward(re *regexp.Regexp, from int) (*Match, error) {
+  return findBackward(self, re, from)
+}
+
+// Find the successive, non-overlapping, matches of re in the buffer,
+// as GapBuffer.FindAll.
+func (self *PieceTable) FindAll(re *regexp.Regexp, n int) []*Match {
+  return findAll(self, re, n)
+}
+
+func findForward(b searchable, re *regexp.Regexp, from int) (*Match, error) {
+  if err := checkPosition(from, b.Length()); err != nil {
+    return nil, err
+  }
+  return findFrom(b, re, nil, from)
+}
+
+// Find the first match of re at or after from, using context, the
+// result of withContext(re), if from isn't the start of the buffer.
+// If context is nil, it's made when it's needed.
+func findFrom(b searchable, re *regexp.Regexp, context *regexp.Regexp, from int) (*Match, error) {
+  start, search := from, re
+  if from > 0 {
+    before, _ := b.GetRange(max(from-utf8.UTFMax, 0), from)
+    _, size := utf8.DecodeLastRune(before)
+    start = from - size
+    if context == nil {
+      context = withContext(re)
+    }
+    search = context
+  }
+  loc := search.FindReaderSubmatchIndex(b.runesFrom(start))
+  if loc == nil {
+    return nil, MATCH_FAILED.Err()
+  }
+  if start < from {
+    // Skip the context rune at the start of the match.
+    _, size, _ := b.GetRuneAt(loc[0] + start)
+    loc[0] += size
+  }
+  match := &Match{loc[0] + start, loc[1] + start, make([]Span, len(loc)/2)}
+  for i := range match.Groups {
+    if loc[2*i] < 0 {
+      match.Groups[i] = Span{-1, -1}
+    } else {
+      match.Groups[i] = Span{loc[2*i] + start, loc[2*i+1] + start}
+    }
+  }
+  return match, nil
+}
+
+// Make a regexp that matches one rune of context followed by re. The
+// subexpressions are numbered and named just as they are in re.
+func withContext(re *regexp.Regexp) *regexp.Regexp {
+  return regexp.MustCompile("(?s:.)(?:" + re.String() + ")")
+}
+
+func findBackward(b searchable, re *regexp.Regexp, from int) (*Match, error) {
+  if err := checkPosition(from, b.Length()); err != nil {
+    return nil, err
+  }
+  var last *Match
+  eachMatch(b, re, -1, func(m *Match) bool {
+    if m.Start >= from {
+      return false
+    }
+    last = m
+    return true
+  })
+  if last == nil {
+    return nil, MATCH_FAILED.Err()
+  }
+  return last, nil
+}
+
+func findAll(b searchable, re *regexp.Regexp, n int) []*Match {
+  var result []*Match
+  eachMatch(b, re, n, func(m *Match) bool {
+    result = append(result, m)
+    return true
+  })
+  return result
+}
+
+// Call f for each of the first n matches of re, or all of them if n is
+// negative, until f returns false.
+func eachMatch(b searchable, re *regexp.Regexp, n int, f func(m *Match) bool) {
+  context := withContext(re)
+  pos, prev_end := 0, -1
+  for count := 0; n < 0 || count < n; {
+    if pos > b.Length() {
+      return
+    }
+    m, err := findFrom(b, re, context, pos)
+    if err != nil {
+      return
+    }
+    if m.Start == m.End {
+      // Step over one rune, so that the next search makes progress.
+      if _, size, err := b.GetRuneAt(m.End); err == nil {
+        pos = m.End + size
+      } else {
+        pos = m.End + 1
+      }
+      if m.Start == prev_end {
+        continue
+      }
+    } else {
+      pos = m.End
+    }
+    prev_end = m.End
+    count++
+    if !f(m) {
+      return
+    }
+  }
+}
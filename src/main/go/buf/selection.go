@@ -0,0 +1,133 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: selection.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: The span cursor used by the Apex command language.
+//
+// In ACL, the cursor isn't a point between two characters: it spans a
+// range of text, from its front to its tail. A selection is a pair of
+// marks. The front has left gravity and the tail has right gravity, so
+// text inserted at either end of the selection becomes part of it,
+// and an empty selection grows to cover text inserted into it.
+
+package buf
+
+type Selection struct {
+  front *Mark
+  tail  *Mark
+}
+
+func (self *Selection) Front() int { return self.front.pos }
+
+func (self *Selection) Tail() int { return self.tail.pos }
+
+func (self *Selection) Length() int { return self.tail.pos - self.front.pos }
+
+func (self *Selection) IsEmpty() bool { return self.front.pos == self.tail.pos }
+
+func (self *GapBuffer) newSelection(front int, tail int) *Selection {
+  f, _ := self.NewMark(front, LEFT_GRAVITY)
+  t, _ := self.NewMark(tail, RIGHT_GRAVITY)
+  return &Selection{f, t}
+}
+
+// Get the buffer's selection.
+func (self *GapBuffer) GetSelection() *Selection { return self.selection }
+
+func (self *GapBuffer) checkRange(front int, tail int) error {
+  if err := checkPosition(front, self.Length()); err != nil {
+    return err
+  } else if err := checkPosition(tail, self.Length()); err != nil {
+    return err
+  } else if front > tail {
+    return INVALID_RANGE.Err()
+  }
+  return nil
+}
+
+// Select the text from front to tail ("pick", in ACL).
+func (self *GapBuffer) SelectRange(front int, tail int) error {
+  if err := self.checkRange(front, tail); err != nil {
+    return err
+  }
+  self.selection.front.pos = front
+  self.selection.tail.pos = tail
+  return nil
+}
+
+// Select the entire buffer.
+func (self *GapBuffer) SelectAll() {
+  self.SelectRange(0, self.Length())
+}
+
+// Move the front of the selection by a distance. A negative distance
+// extends the selection backwards. The front can't be moved past
+// the tail.
+func (self *GapBuffer) ExtendFront(dist int) error {
+  return self.SelectRange(self.selection.Front()+dist, self.selection.Tail())
+}
+
+// Move the tail of the selection by a distance. A negative distance
+// shrinks the selection. The tail can't be moved before the front.
+func (self *GapBuffer) ExtendTail(dist int) error {
+  return self.SelectRange(self.selection.Front(), self.selection.Tail()+dist)
+}
+
+// Move both ends of the selection by a distance ("jump", in ACL).
+func (self *GapBuffer) MoveSelection(dist int) error {
+  return self.SelectRange(self.selection.Front()+dist, self.selection.Tail()+dist)
+}
+
+// Get the selected text.
+func (self *GapBuffer) CopySelection() []uint8 {
+  result := make([]uint8, 0, self.selection.Length())
+  return self.appendRange(result, self.selection.Front(), self.selection.Tail())
+}
+
+// Delete the selected text, leaving an empty selection where it was.
+func (self *GapBuffer) CutSelection() []uint8 {
+  self.MoveCursorTo(self.selection.Front())
+  return self.cut(self.selection.Length())
+}
+
+// Replace the selected text. The selection covers the new text
+// afterwards, and the replacement is undone as a single step.
+func (self *GapBuffer) ReplaceSelection(s string) {
+  self.BeginUndoGroup()
+  self.CutSelection()
+  self.insertChars([]uint8(s))
+  self.EndUndoGroup()
+}
+
+// Insert text immediately before the selection, without making it
+// part of the selection.
+func (self *GapBuffer) InsertBeforeSelection(s string) {
+  front := self.selection.Front()
+  self.MoveCursorTo(front)
+  self.insertChars([]uint8(s))
+  self.selection.front.pos = front + len(s)
+  if self.selection.tail.pos < self.selection.front.pos {
+    self.selection.tail.pos = self.selection.front.pos
+  }
+}
+
+// Append text immediately after the selection, without making it
+// part of the selection.
+func (self *GapBuffer) AppendToSelection(s string) {
+  tail := self.selection.Tail()
+  self.MoveCursorTo(tail)
+  self.insertChars([]uint8(s))
+  self.selection.tail.pos = tail
+}
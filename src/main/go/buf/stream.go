@@ -0,0 +1,180 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: stream.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: The standard io interfaces for gap buffers.
+//
+// A gap buffer's own Read and Write methods load and save its file,
+// so it can't be an io.Reader or an io.Writer itself. Instead, a
+// Reader reads the buffer from a position of its own, and a Writer
+// inserts what's written to it at the buffer's cursor. ReadAt and
+// WriteTo don't need any state, so the buffer provides them directly.
+// All of them copy straight out of the array on either side of the
+// gap. A Reader reads the live contents of the buffer, so edits made
+// while it's in use shift the text under it.
+
+package buf
+
+import (
+  "errors"
+  "io"
+  "unicode/utf8"
+)
+
+// Copy the text starting at off into p, as io.ReaderAt.
+func (self *GapBuffer) ReadAt(p []byte, off int64) (n int, err error) {
+  if off < 0 {
+    return 0, errors.New("buf.GapBuffer.ReadAt: negative offset")
+  }
+  pos := int(off)
+  if pos < self.gap_start {
+    n = copy(p, self.data[pos:self.gap_start])
+    pos += n
+  }
+  if n < len(p) && pos < self.Length() {
+    n += copy(p[n:], self.data[self.gap_end+pos-self.gap_start:])
+  }
+  if n < len(p) {
+    err = io.EOF
+  }
+  return n, err
+}
+
+// Write the contents of the buffer to w, as io.WriterTo.
+func (self *GapBuffer) WriteTo(w io.Writer) (int64, error) {
+  n, err := w.Write(self.data[:self.gap_start])
+  if err != nil {
+    return int64(n), err
+  }
+  m, err := w.Write(self.data[self.gap_end:])
+  return int64(n + m), err
+}
+
+// Get a reader that starts at the beginning of the buffer.
+func (self *GapBuffer) NewReader() *Reader {
+  return &Reader{self, 0, -1}
+}
+
+// Get a writer that inserts at the buffer's cursor.
+func (self *GapBuffer) NewWriter() *Writer {
+  return &Writer{self}
+}
+
+// A reader for the contents of a gap buffer. It implements io.Reader,
+// io.ReaderAt, io.RuneScanner, io.Seeker and io.WriterTo.
+type Reader struct {
+  buf       *GapBuffer
+  pos       int
+  last_rune int
+}
+
+func (self *Reader) Read(p []byte) (int, error) {
+  if self.pos >= self.buf.Length() {
+    return 0, io.EOF
+  }
+  n, _ := self.buf.ReadAt(p, int64(self.pos))
+  self.pos += n
+  self.last_rune = -1
+  return n, nil
+}
+
+func (self *Reader) ReadAt(p []byte, off int64) (int, error) {
+  return self.buf.ReadAt(p, off)
+}
+
+func (self *Reader) ReadRune() (r rune, size int, err error) {
+  r, size, err = self.buf.GetRuneAt(self.pos)
+  if err != nil {
+    self.last_rune = -1
+    return 0, 0, io.EOF
+  }
+  self.last_rune = self.pos
+  self.pos += size
+  return r, size, nil
+}
+
+// Step back over the rune read by the last call to ReadRune.
+func (self *Reader) UnreadRune() error {
+  if self.last_rune < 0 {
+    return errors.New("buf.Reader.UnreadRune: previous operation was not ReadRune")
+  }
+  self.pos = self.last_rune
+  self.last_rune = -1
+  return nil
+}
+
+func (self *Reader) Seek(offset int64, whence int) (int64, error) {
+  var pos int64
+  switch whence {
+  case io.SeekStart:
+    pos = offset
+  case io.SeekCurrent:
+    pos = int64(self.pos) + offset
+  case io.SeekEnd:
+    pos = int64(self.buf.Length()) + offset
+  default:
+    return 0, errors.New("buf.Reader.Seek: invalid whence")
+  }
+  if pos < 0 {
+    return 0, errors.New("buf.Reader.Seek: negative position")
+  }
+  self.pos = int(pos)
+  self.last_rune = -1
+  return pos, nil
+}
+
+// Write the rest of the buffer to w.
+func (self *Reader) WriteTo(w io.Writer) (int64, error) {
+  self.last_rune = -1
+  if self.pos >= self.buf.Length() {
+    return 0, nil
+  }
+  var n, m int
+  var err error
+  if self.pos < self.buf.gap_start {
+    n, err = w.Write(self.buf.data[self.pos:self.buf.gap_start])
+    self.pos += n
+    if err != nil {
+      return int64(n), err
+    }
+  }
+  m, err = w.Write(self.buf.data[self.buf.gap_end+self.pos-self.buf.gap_start:])
+  self.pos += m
+  return int64(n + m), err
+}
+
+// A writer that inserts text at the cursor of a gap buffer. Each write
+// is a separate undo step.
+type Writer struct {
+  buf *GapBuffer
+}
+
+func (self *Writer) Write(p []byte) (int, error) {
+  self.buf.InsertChars(p)
+  return len(p), nil
+}
+
+func (self *Writer) WriteString(s string) (int, error) {
+  self.buf.InsertString(s)
+  return len(s), nil
+}
+
+// Insert a rune, encoded as UTF-8.
+func (self *Writer) WriteRune(r rune) (int, error) {
+  var bytes [utf8.UTFMax]uint8
+  n := utf8.EncodeRune(bytes[:], r)
+  self.buf.InsertChars(bytes[:n])
+  return n, nil
+}
@@ -0,0 +1,326 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: syncbuf.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: A wrapper that makes an edit buffer safe to share
+//   between goroutines.
+//
+// None of the buffer implementations do any locking of their own. A
+// SyncBuffer wraps a buffer with a reader/writer lock: queries take
+// the read lock, and everything that changes the buffer - including
+// moving the cursor - takes the write lock. Every change to the text
+// bumps the buffer's version number.
+//
+// A snapshot is an immutable copy of the text at a particular
+// version, which can be read without holding any lock. A snapshot of
+// a rope shares its tree, and a snapshot of a gap buffer is one of
+// its BufferVersions, which share its array until the next edit, so
+// neither copies anything. A snapshot of any other kind of buffer
+// costs one copy of the text. Snapshots are cached, so taking several
+// at the same version only pays once.
+//
+// Change listeners are called with the write lock held, so they
+// mustn't call back into the SyncBuffer.
+
+package buf
+
+import (
+  "sync"
+)
+
+type SyncBuffer struct {
+  lock      sync.RWMutex
+  buf       EditBuffer
+  version   int
+  snap_lock sync.Mutex
+  snapshot  *Snapshot
+}
+
+func NewSyncBuffer(b EditBuffer) *SyncBuffer {
+  return &SyncBuffer{buf: b}
+}
+
+// The current version of the text. It changes every time the text
+// does.
+func (self *SyncBuffer) Version() int {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.version
+}
+
+// Run f with the read lock held, for a series of queries that need
+// to see a consistent view of the buffer. f mustn't change the buffer.
+func (self *SyncBuffer) View(f func(b EditBuffer)) {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  f(self.buf)
+}
+
+// Run f with the write lock held, for a series of edits that need
+// to happen together.
+func (self *SyncBuffer) Update(f func(b EditBuffer)) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  f(self.buf)
+  self.version++
+}
+
+// Get a snapshot of the current text.
+func (self *SyncBuffer) Snapshot() *Snapshot {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  self.snap_lock.Lock()
+  defer self.snap_lock.Unlock()
+  if self.snapshot == nil || self.snapshot.version != self.version {
+    var text snapshotText
+    switch b := self.buf.(type) {
+    case *Rope:
+      text = &Rope{root: b.root}
+    case *GapBuffer:
+      // Taking a version changes the gap buffer's bookkeeping, but not
+      // its text, so the read lock is enough: snap_lock keeps other
+      // snapshots out, and nothing else touches it.
+      text = b.CurrentVersion()
+    default:
+      chars, _ := self.buf.GetRange(0, self.buf.Length())
+      text = &Rope{root: ropeBuild(chars)}
+    }
+    self.snapshot = &Snapshot{self.version, text}
+  }
+  return self.snapshot
+}
+
+// Run an edit with the write lock held.
+func (self *SyncBuffer) edit(f func()) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  f()
+  self.version++
+}
+
+// Run f with the write lock held, for things like cursor motion that
+// change the buffer but not its text, and so don't change the version.
+func (self *SyncBuffer) locked(f func()) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  f()
+}
+
+func (self *SyncBuffer) Length() int {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.buf.Length()
+}
+
+func (self *SyncBuffer) Clear() {
+  self.edit(func() { self.buf.Clear() })
+}
+
+func (self *SyncBuffer) GetCharAt(pos int) (uint8, error) {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.buf.GetCharAt(pos)
+}
+
+func (self *SyncBuffer) GetRange(start int, end int) ([]uint8, error) {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.buf.GetRange(start, end)
+}
+
+func (self *SyncBuffer) GetPositionOfLine(linenum int) (int, error) {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.buf.GetPositionOfLine(linenum)
+}
+
+func (self *SyncBuffer) GetPositionOfLineAndColumn(linenum int, colnum int) (int, error) {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.buf.GetPositionOfLineAndColumn(linenum, colnum)
+}
+
+func (self *SyncBuffer) GetCoordinates(pos int) (int, int, error) {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.buf.GetCoordinates(pos)
+}
+
+func (self *SyncBuffer) LineCount() int {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.buf.LineCount()
+}
+
+func (self *SyncBuffer) MoveCursorTo(pos int) {
+  self.locked(func() { self.buf.MoveCursorTo(pos) })
+}
+
+func (self *SyncBuffer) MoveToLine(linenum int) {
+  self.locked(func() { self.buf.MoveToLine(linenum) })
+}
+
+func (self *SyncBuffer) MoveCursorBy(distance int) {
+  self.locked(func() { self.buf.MoveCursorBy(distance) })
+}
+
+func (self *SyncBuffer) StepCursorBackward() (err error) {
+  self.locked(func() { err = self.buf.StepCursorBackward() })
+  return
+}
+
+func (self *SyncBuffer) StepCursorForward() (err error) {
+  self.locked(func() { err = self.buf.StepCursorForward() })
+  return
+}
+
+func (self *SyncBuffer) GetCurrentPosition() int {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.buf.GetCurrentPosition()
+}
+
+func (self *SyncBuffer) GetCurrentLine() int {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.buf.GetCurrentLine()
+}
+
+func (self *SyncBuffer) GetCurrentColumn() int {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.buf.GetCurrentColumn()
+}
+
+func (self *SyncBuffer) InsertChar(c uint8) {
+  self.edit(func() { self.buf.InsertChar(c) })
+}
+
+func (self *SyncBuffer) InsertChars(cs []uint8) {
+  self.edit(func() { self.buf.InsertChars(cs) })
+}
+
+func (self *SyncBuffer) InsertString(s string) {
+  self.edit(func() { self.buf.InsertString(s) })
+}
+
+func (self *SyncBuffer) Cut(numChars int) (cutbuf []uint8) {
+  self.edit(func() { cutbuf = self.buf.Cut(numChars) })
+  return
+}
+
+func (self *SyncBuffer) Copy(numChars int) []uint8 {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.buf.Copy(numChars)
+}
+
+func (self *SyncBuffer) Undo() (err error) {
+  self.edit(func() { err = self.buf.Undo() })
+  return
+}
+
+func (self *SyncBuffer) Redo() (err error) {
+  self.edit(func() { err = self.buf.Redo() })
+  return
+}
+
+func (self *SyncBuffer) CanUndo() bool {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.buf.CanUndo()
+}
+
+func (self *SyncBuffer) CanRedo() bool {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.buf.CanRedo()
+}
+
+func (self *SyncBuffer) Subscribe(listener ChangeListener) (id int) {
+  self.locked(func() { id = self.buf.Subscribe(listener) })
+  return
+}
+
+func (self *SyncBuffer) Unsubscribe(id int) (err error) {
+  self.locked(func() { err = self.buf.Unsubscribe(id) })
+  return
+}
+
+func (self *SyncBuffer) BeginChangeBatch() {
+  self.locked(func() { self.buf.BeginChangeBatch() })
+}
+
+func (self *SyncBuffer) EndChangeBatch() (err error) {
+  self.locked(func() { err = self.buf.EndChangeBatch() })
+  return
+}
+
+// For debugging purposes: return the text before and after the
+// cursor of the wrapped buffer.
+func (self *SyncBuffer) StringPair() (before string, after string) {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.buf.(interface {
+    StringPair() (string, string)
+  }).StringPair()
+}
+
+////////////////////////////////////////////////////////////////
+// Snapshots
+
+// A read-only view of a buffer's text at one version.
+type Snapshot struct {
+  version int
+  text    snapshotText
+}
+
+// The text of a snapshot: a rope, or a version of a gap buffer.
+type snapshotText interface {
+  Length() int
+  GetCharAt(pos int) (uint8, error)
+  GetRange(start int, end int) ([]uint8, error)
+  GetPositionOfLine(linenum int) (int, error)
+  GetCoordinates(pos int) (int, int, error)
+  LineCount() int
+  Bytes() []uint8
+  String() string
+}
+
+func (self *Snapshot) Version() int { return self.version }
+
+func (self *Snapshot) Length() int { return self.text.Length() }
+
+func (self *Snapshot) GetCharAt(pos int) (uint8, error) {
+  return self.text.GetCharAt(pos)
+}
+
+func (self *Snapshot) GetRange(start int, end int) ([]uint8, error) {
+  return self.text.GetRange(start, end)
+}
+
+func (self *Snapshot) GetPositionOfLine(linenum int) (int, error) {
+  return self.text.GetPositionOfLine(linenum)
+}
+
+func (self *Snapshot) GetCoordinates(pos int) (int, int, error) {
+  return self.text.GetCoordinates(pos)
+}
+
+func (self *Snapshot) LineCount() int { return self.text.LineCount() }
+
+func (self *Snapshot) Bytes() []uint8 { return self.text.Bytes() }
+
+func (self *Snapshot) String() string { return self.text.String() }
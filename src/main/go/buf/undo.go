@@ -0,0 +1,359 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: undo.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Undo records, and the undo tree that holds them.
+//   Every edit becomes a node in the tree; undoing an edit moves
+//   to its parent, and making a new edit after an undo starts a
+//   new branch rather than throwing away the old one.
+
+package buf
+
+import (
+  "time"
+)
+
+// The clock used to timestamp undo records. Tests replace it so
+// that they can control the passage of time.
+var clock = time.Now
+
+//
+// Undo-record types
+//
+
+// A basic insert operation. The inserted characters are kept so
+// that the insert can be replayed after it's been undone.
+type InsertOperation struct {
+  buf    *GapBuffer
+  start  int
+  chars  []uint8
+  when   time.Time
+}
+
+// A cut operation.
+type DeleteOperation struct {
+  buf      *GapBuffer
+  position int
+  chars    []uint8
+  when     time.Time
+}
+
+// A compound operation, made up of a sequence of edits that are
+// undone and redone as a single step.
+type GroupOperation struct {
+  ops []UndoOperation
+}
+
+func RecordInsert(b *GapBuffer, start int, chars []uint8) (result *InsertOperation) {
+  saved := make([]uint8, len(chars))
+  copy(saved, chars)
+  result = &InsertOperation{b, start, saved, clock()}
+  return
+}
+
+func RecordDelete(b *GapBuffer, pos int, chars []uint8) (result *DeleteOperation) {
+  result = &DeleteOperation{b, pos, chars, clock()}
+  return
+}
+
+func (self *InsertOperation) GetBuffer() EditBuffer {
+  return self.buf
+}
+
+func (self *InsertOperation) Undo() {
+  self.buf.MoveCursorTo(self.start)
+  _ = self.buf.Cut(len(self.chars))
+}
+
+func (self *InsertOperation) Redo() {
+  self.buf.MoveCursorTo(self.start)
+  self.buf.InsertChars(self.chars)
+}
+
+func (self *InsertOperation) Timestamp() time.Time { return self.when }
+
+func (self *DeleteOperation) GetBuffer() EditBuffer {
+  return self.buf
+}
+
+func (self *DeleteOperation) Undo() {
+  self.buf.MoveCursorTo(self.position)
+  self.buf.InsertChars(self.chars)
+  self.buf.MoveCursorTo(self.position)
+}
+
+func (self *DeleteOperation) Redo() {
+  self.buf.MoveCursorTo(self.position)
+  _ = self.buf.Cut(len(self.chars))
+}
+
+func (self *DeleteOperation) Timestamp() time.Time { return self.when }
+
+func (self *GroupOperation) Undo() {
+  for i := len(self.ops) - 1; i >= 0; i-- {
+    self.ops[i].Undo()
+  }
+}
+
+func (self *GroupOperation) Redo() {
+  for i := range self.ops {
+    self.ops[i].Redo()
+  }
+}
+
+// A group is timestamped with the time of its last edit.
+func (self *GroupOperation) Timestamp() (t time.Time) {
+  if len(self.ops) > 0 {
+    t = self.ops[len(self.ops)-1].Timestamp()
+  }
+  return
+}
+
+//
+// The undo tree
+//
+
+// A node in the undo tree. The root node holds no operation: it
+// represents the state of the buffer before any edits were made.
+type UndoNode struct {
+  op       UndoOperation
+  parent   *UndoNode
+  children []*UndoNode
+  redo     *UndoNode  // the child that Redo will move to
+  seq      int
+  when     time.Time
+}
+
+func newUndoNode(op UndoOperation, parent *UndoNode, seq int, when time.Time) *UndoNode {
+  return &UndoNode{op, parent, make([]*UndoNode, 0, 1), nil, seq, when}
+}
+
+// The sequence number of the node. Nodes are numbered in the order
+// that their edits were made, starting with 0 for the root.
+func (self *UndoNode) Id() int { return self.seq }
+
+func (self *UndoNode) Time() time.Time { return self.when }
+
+func (self *UndoNode) Parent() *UndoNode { return self.parent }
+
+func (self *UndoNode) Children() []*UndoNode { return self.children }
+
+func (self *UndoNode) Operation() UndoOperation { return self.op }
+
+func (self *GapBuffer) resetUndo() {
+  self.undo_root = newUndoNode(nil, nil, 0, clock())
+  self.undo_current = self.undo_root
+  self.undo_nodes = []*UndoNode{self.undo_root}
+  for len(self.undo_groups) > 0 {
+    self.popUndoGroup()
+    self.EndChangeBatch()
+  }
+}
+
+// Record a new edit. A new edit is added as a child of the current
+// node, and becomes the branch that Redo will follow. While an undo
+// group is open, the edit is added to the innermost group instead.
+func (self *GapBuffer) pushUndo(u UndoOperation) {
+  if len(self.undo_groups) > 0 {
+    group := self.undo_groups[len(self.undo_groups)-1]
+    group.ops = append(group.ops, u)
+    return
+  }
+  node := newUndoNode(u, self.undo_current, len(self.undo_nodes), u.Timestamp())
+  self.undo_current.children = append(self.undo_current.children, node)
+  self.undo_current.redo = node
+  self.undo_current = node
+  self.undo_nodes = append(self.undo_nodes, node)
+}
+
+// Undo the current edit, moving to its parent in the undo tree.
+func (self *GapBuffer) Undo() error {
+  if !self.CanUndo() {
+    return INVALID.Err()
+  }
+  self.undoing = true
+  self.kind = UNDO_CHANGE
+  self.BeginChangeBatch()
+  node := self.undo_current
+  node.op.Undo()
+  node.parent.redo = node
+  self.undo_current = node.parent
+  self.EndChangeBatch()
+  self.kind = EDIT_CHANGE
+  self.undoing = false
+  return nil
+}
+
+// Replay the most recently undone edit. If the current node has
+// several branches, this follows the one that was most recently
+// visited.
+func (self *GapBuffer) Redo() error {
+  if !self.CanRedo() {
+    return INVALID.Err()
+  }
+  self.undoing = true
+  self.kind = REDO_CHANGE
+  self.BeginChangeBatch()
+  node := self.undo_current.redo
+  node.op.Redo()
+  self.undo_current = node
+  self.EndChangeBatch()
+  self.kind = EDIT_CHANGE
+  self.undoing = false
+  return nil
+}
+
+// Undo and redo aren't available while an undo group is open: the
+// group's edits haven't been recorded in the undo tree yet.
+func (self *GapBuffer) CanUndo() bool {
+  return self.undo_current != self.undo_root && len(self.undo_groups) == 0
+}
+
+func (self *GapBuffer) CanRedo() bool {
+  return self.undo_current.redo != nil && len(self.undo_groups) == 0
+}
+
+func (self *GapBuffer) UndoTreeRoot() *UndoNode { return self.undo_root }
+
+func (self *GapBuffer) CurrentUndoNode() *UndoNode { return self.undo_current }
+
+// Get the tips of every branch in the undo tree, in the order that
+// they were created.
+func (self *GapBuffer) UndoBranches() []*UndoNode {
+  result := make([]*UndoNode, 0, 1)
+  for _, node := range self.undo_nodes {
+    if len(node.children) == 0 {
+      result = append(result, node)
+    }
+  }
+  return result
+}
+
+// Get an undo node by its sequence number.
+func (self *GapBuffer) GetUndoNode(id int) (*UndoNode, error) {
+  if id < 0 || id >= len(self.undo_nodes) {
+    return nil, INVALID.Err()
+  }
+  return self.undo_nodes[id], nil
+}
+
+// Move the buffer to the state represented by an arbitrary node
+// in the undo tree. This undoes edits back to the closest common
+// ancestor of the current node and the target, and then redoes
+// edits down the branch to the target.
+func (self *GapBuffer) UndoTo(target *UndoNode) error {
+  if len(self.undo_groups) > 0 || target == nil ||
+    target.seq >= len(self.undo_nodes) || self.undo_nodes[target.seq] != target {
+    return INVALID.Err()
+  }
+  self.BeginChangeBatch()
+  defer self.EndChangeBatch()
+  ancestors := make(map[*UndoNode]bool)
+  for n := self.undo_current; n != nil; n = n.parent {
+    ancestors[n] = true
+  }
+  path := make([]*UndoNode, 0, 10)
+  common := target
+  for !ancestors[common] {
+    path = append(path, common)
+    common = common.parent
+  }
+  for self.undo_current != common {
+    self.Undo()
+  }
+  for i := len(path) - 1; i >= 0; i-- {
+    self.undo_current.redo = path[i]
+    self.Redo()
+  }
+  return nil
+}
+
+// Move the buffer back to the state it was in at a point in time
+// the given duration before the current edit.
+func (self *GapBuffer) UndoEarlier(d time.Duration) error {
+  return self.UndoTo(self.undoNodeAtTime(self.undo_current.when.Add(-d)))
+}
+
+// Move the buffer forward to the state it was in at a point in
+// time the given duration after the current edit.
+func (self *GapBuffer) UndoLater(d time.Duration) error {
+  return self.UndoTo(self.undoNodeAtTime(self.undo_current.when.Add(d)))
+}
+
+// Find the most recent node which was created no later than the
+// time t. Nodes are created in time order, so this can use a binary
+// search.
+func (self *GapBuffer) undoNodeAtTime(t time.Time) *UndoNode {
+  low, high := 0, len(self.undo_nodes)
+  for high-low > 1 {
+    mid := (low + high) / 2
+    if self.undo_nodes[mid].when.After(t) {
+      high = mid
+    } else {
+      low = mid
+    }
+  }
+  return self.undo_nodes[low]
+}
+
+//
+// Undo groups
+//
+
+// Start a group of edits which will be undone as a single
+// operation. Groups can be nested: the edits of an inner group
+// become part of the enclosing group when it's ended. A group is
+// also a change batch, so listeners see its changes together.
+func (self *GapBuffer) BeginUndoGroup() {
+  self.undo_groups = append(self.undo_groups, &GroupOperation{})
+  self.BeginChangeBatch()
+}
+
+// Close the innermost open undo group.
+func (self *GapBuffer) EndUndoGroup() error {
+  if len(self.undo_groups) == 0 {
+    return INVALID.Err()
+  }
+  group := self.popUndoGroup()
+  if len(group.ops) > 0 {
+    self.pushUndo(group)
+  }
+  self.EndChangeBatch()
+  return nil
+}
+
+// Close the innermost open undo group, rolling back all of the
+// edits that were made inside of it.
+func (self *GapBuffer) AbortUndoGroup() error {
+  if len(self.undo_groups) == 0 {
+    return INVALID.Err()
+  }
+  group := self.popUndoGroup()
+  self.undoing = true
+  self.kind = UNDO_CHANGE
+  group.Undo()
+  self.kind = EDIT_CHANGE
+  self.undoing = false
+  self.EndChangeBatch()
+  return nil
+}
+
+func (self *GapBuffer) InUndoGroup() bool { return len(self.undo_groups) > 0 }
+
+func (self *GapBuffer) popUndoGroup() (group *GroupOperation) {
+  group = self.undo_groups[len(self.undo_groups)-1]
+  self.undo_groups = self.undo_groups[:len(self.undo_groups)-1]
+  return
+}
@@ -0,0 +1,208 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: undofile.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Saving and restoring undo history in a sidecar file
+//   next to the file being edited.
+//
+// The undo file is a JSON document. It records a hash of the file
+// contents that the history applies to, and the nodes of the undo
+// tree in sequence order, so that parent links can be stored as node
+// numbers. The format carries a version number; any change to it
+// must bump undoFileVersion. The undo file holds every piece of text
+// that was ever inserted or deleted, so it gets the permissions and
+// the owner of the file that it belongs to.
+
+package buf
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "io/ioutil"
+  "path/filepath"
+  "time"
+)
+
+const undoFileVersion = 1
+
+type undoFileRecord struct {
+  Version  int              `json:"version"`
+  Hash     string           `json:"hash"`
+  Current  int              `json:"current"`
+  RootTime int64            `json:"root_time"`
+  Nodes    []undoNodeRecord `json:"nodes"`
+}
+
+// A non-root node of the undo tree. Redo is the sequence number of
+// the child that Redo follows, or -1 if there isn't one.
+type undoNodeRecord struct {
+  Parent int          `json:"parent"`
+  Redo   int          `json:"redo"`
+  Op     undoOpRecord `json:"op"`
+}
+
+// An undo operation. Kind is one of "insert", "delete" or "group";
+// Chars holds the inserted or deleted text, and Ops the members of
+// a group. Time is in nanoseconds since the Unix epoch.
+type undoOpRecord struct {
+  Kind  string         `json:"kind"`
+  Pos   int            `json:"pos,omitempty"`
+  Chars []uint8        `json:"chars,omitempty"`
+  Time  int64          `json:"time,omitempty"`
+  Ops   []undoOpRecord `json:"ops,omitempty"`
+}
+
+// The name of the file that holds the undo history for a file:
+// for "dir/name", it's "dir/.name.undo".
+func UndoFileName(filename string) string {
+  dir, base := filepath.Split(filename)
+  return filepath.Join(dir, "."+base+".undo")
+}
+
+func contentHash(contents []uint8) string {
+  sum := sha256.Sum256(contents)
+  return hex.EncodeToString(sum[:])
+}
+
+// Turn on or off saving of the undo history when the buffer
+// is written.
+func (self *GapBuffer) SetPersistentUndo(keep bool) { self.keep_undo = keep }
+
+// Open a file buffer, restoring the undo history that was saved the
+// last time the file was written. The history is only restored if
+// the file hasn't been changed since it was saved; otherwise, the
+// buffer starts with an empty history. Either way, the history will
+// be saved when the buffer is written.
+func NewFileBufferWithHistory(filename string) (buf *GapBuffer, err error) {
+  buf, err = NewFileBuffer(filename)
+  if err != nil {
+    return
+  }
+  buf.SetPersistentUndo(true)
+  buf.readUndoFile()
+  return
+}
+
+func (self *GapBuffer) writeUndoFile(hash string) error {
+  record := undoFileRecord{Version: undoFileVersion, Hash: hash,
+    Current: self.undo_current.seq, RootTime: self.undo_root.when.UnixNano(),
+    Nodes: make([]undoNodeRecord, 0, len(self.undo_nodes)-1)}
+  for _, node := range self.undo_nodes[1:] {
+    op, ok := encodeUndoOp(node.op)
+    if !ok {
+      return INVALID.Err()
+    }
+    redo := -1
+    if node.redo != nil {
+      redo = node.redo.seq
+    }
+    record.Nodes = append(record.Nodes, undoNodeRecord{node.parent.seq, redo, op})
+  }
+  data, err := json.Marshal(&record)
+  if err != nil {
+    return INVALID.Err()
+  }
+  return writeCompanionFile(UndoFileName(self.filename), data, self.filename)
+}
+
+// Restore the undo history from the undo file, if there is one and
+// it matches the current file contents. The history is left alone
+// if anything about the undo file is wrong.
+func (self *GapBuffer) readUndoFile() error {
+  data, err := ioutil.ReadFile(UndoFileName(self.filename))
+  if err != nil {
+    return ioError(err)
+  }
+  var record undoFileRecord
+  if json.Unmarshal(data, &record) != nil || record.Version != undoFileVersion {
+    return INVALID.Err()
+  }
+  if record.Hash != self.disk.hash {
+    return MATCH_FAILED.Err()
+  }
+  root := newUndoNode(nil, nil, 0, time.Unix(0, record.RootTime))
+  nodes := []*UndoNode{root}
+  redo := []int{-1}
+  for i, r := range record.Nodes {
+    op, ok := self.decodeUndoOp(r.Op)
+    if !ok || r.Parent < 0 || r.Parent > i {
+      return INVALID.Err()
+    }
+    parent := nodes[r.Parent]
+    node := newUndoNode(op, parent, i+1, op.Timestamp())
+    parent.children = append(parent.children, node)
+    nodes = append(nodes, node)
+    redo = append(redo, r.Redo)
+  }
+  for i, r := range redo {
+    if r > 0 && r < len(nodes) && nodes[r].parent == nodes[i] {
+      nodes[i].redo = nodes[r]
+    }
+  }
+  if record.Current < 0 || record.Current >= len(nodes) {
+    return INVALID.Err()
+  }
+  self.undo_root = root
+  self.undo_nodes = nodes
+  self.undo_current = nodes[record.Current]
+  return nil
+}
+
+func encodeUndoOp(u UndoOperation) (r undoOpRecord, ok bool) {
+  ok = true
+  switch op := u.(type) {
+  case *InsertOperation:
+    r = undoOpRecord{Kind: "insert", Pos: op.start, Chars: op.chars,
+      Time: op.when.UnixNano()}
+  case *DeleteOperation:
+    r = undoOpRecord{Kind: "delete", Pos: op.position, Chars: op.chars,
+      Time: op.when.UnixNano()}
+  case *GroupOperation:
+    r = undoOpRecord{Kind: "group", Ops: make([]undoOpRecord, len(op.ops))}
+    for i := range op.ops {
+      if r.Ops[i], ok = encodeUndoOp(op.ops[i]); !ok {
+        return
+      }
+    }
+  default:
+    ok = false
+  }
+  return
+}
+
+func (self *GapBuffer) decodeUndoOp(r undoOpRecord) (u UndoOperation, ok bool) {
+  ok = true
+  switch r.Kind {
+  case "insert":
+    u = &InsertOperation{self, r.Pos, r.Chars, time.Unix(0, r.Time)}
+  case "delete":
+    u = &DeleteOperation{self, r.Pos, r.Chars, time.Unix(0, r.Time)}
+  case "group":
+    if len(r.Ops) == 0 {
+      return nil, false
+    }
+    group := &GroupOperation{make([]UndoOperation, len(r.Ops))}
+    for i := range r.Ops {
+      if group.ops[i], ok = self.decodeUndoOp(r.Ops[i]); !ok {
+        return
+      }
+    }
+    u = group
+  default:
+    ok = false
+  }
+  return
+}
@@ -0,0 +1,276 @@
+// Copyright 2011 Mark C. Chu-Carroll
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File: versions.go
+// Author: Mark Chu-Carroll <markcc@gmail.com>
+// Description: Numbered versions of the text of a gap buffer.
+//
+// Every change to the text of a buffer - an insert, a cut, or an
+// edit replayed by undo or redo - produces a new version. The buffer
+// keeps a log of the changes, where entry i is the change that turned
+// version i into version i+1. Running the log backwards from the
+// current text reconstructs any past version, and running an offset
+// forward through it maps the offset into the current version.
+//
+// A BufferVersion of the current text shares the buffer's array. The
+// buffer copies the array the next time it would write to it, so
+// taking a version is cheap, and only the first edit after it pays.
+//
+// The log is trimmed whenever the buffer reads or writes its file:
+// the only versions kept are the one the file was read or written at,
+// which Reload merges against, and those of the BufferVersions that
+// are still in use. Reading the file isn't logged at all unless a
+// BufferVersion is in use, so opening a file doesn't keep a second
+// copy of it. A buffer without a file keeps its whole log until
+// DiscardVersionsBefore is called.
+
+package buf
+
+import (
+  "bytes"
+  "weak"
+)
+
+// A change from one version to the next. Each change either inserts
+// or deletes text, never both.
+type versionChange struct {
+  pos      int
+  deleted  []uint8
+  inserted []uint8
+}
+
+// A read-only copy of the text of a buffer at one version. The text
+// is the concatenation of pre and post.
+type BufferVersion struct {
+  version int
+  pre     []uint8
+  post    []uint8
+}
+
+func (self *BufferVersion) Version() int { return self.version }
+
+func (self *BufferVersion) Length() int { return len(self.pre) + len(self.post) }
+
+func (self *BufferVersion) GetCharAt(pos int) (uint8, error) {
+  if err := checkCharPosition(pos, self.Length()); err != nil {
+    return 0, err
+  } else if pos < len(self.pre) {
+    return self.pre[pos], nil
+  }
+  return self.post[pos-len(self.pre)], nil
+}
+
+func (self *BufferVersion) GetRange(start int, end int) ([]uint8, error) {
+  if err := checkSpan(start, end, self.Length()); err != nil {
+    return nil, err
+  }
+  result := make([]uint8, 0, end-start)
+  if start < len(self.pre) {
+    result = append(result, self.pre[start:min(end, len(self.pre))]...)
+  }
+  if end > len(self.pre) {
+    result = append(result, self.post[max(start-len(self.pre), 0):end-len(self.pre)]...)
+  }
+  return result, nil
+}
+
+func (self *BufferVersion) Bytes() []uint8 {
+  result := make([]uint8, 0, self.Length())
+  return append(append(result, self.pre...), self.post...)
+}
+
+func (self *BufferVersion) String() string { return string(self.Bytes()) }
+
+func (self *BufferVersion) LineCount() int {
+  return countNewlines(self.pre) + countNewlines(self.post) + 1
+}
+
+// Versions have no newline index, so finding lines scans the text.
+func (self *BufferVersion) GetPositionOfLine(linenum int) (int, error) {
+  pos := 0
+  for line := 1; line < linenum; line++ {
+    next := self.indexNewline(pos)
+    if next < 0 {
+      return 0, PAST_END.Err()
+    }
+    pos = next + 1
+  }
+  if pos >= self.Length() {
+    return 0, PAST_END.Err()
+  }
+  return pos, nil
+}
+
+func (self *BufferVersion) GetCoordinates(pos int) (line int, col int, err error) {
+  if err := checkPosition(pos, self.Length()); err != nil {
+    return 0, 0, err
+  }
+  pre, post := self.pre[:min(pos, len(self.pre))], self.post[:max(pos-len(self.pre), 0)]
+  line = countNewlines(pre) + countNewlines(post) + 1
+  if i := bytes.LastIndexByte(post, '\n'); i >= 0 {
+    col = len(post) - i - 1
+  } else if i := bytes.LastIndexByte(pre, '\n'); i >= 0 {
+    col = pos - i - 1
+  } else {
+    col = pos
+  }
+  return line, col, nil
+}
+
+// Find the first newline at or after pos, or -1 if there isn't one.
+func (self *BufferVersion) indexNewline(pos int) int {
+  if pos < len(self.pre) {
+    if i := bytes.IndexByte(self.pre[pos:], '\n'); i >= 0 {
+      return pos + i
+    }
+    pos = len(self.pre)
+  }
+  if i := bytes.IndexByte(self.post[pos-len(self.pre):], '\n'); i >= 0 {
+    return pos + i
+  }
+  return -1
+}
+
+// The current version number of the buffer.
+func (self *GapBuffer) Version() int { return self.version }
+
+// Get a read-only copy of the current text.
+func (self *GapBuffer) CurrentVersion() *BufferVersion {
+  if self.shared == nil || self.shared.version != self.version {
+    self.shared = &BufferVersion{self.version, self.data[:self.gap_start:self.gap_start], self.data[self.gap_end:]}
+    self.trackVersion(self.shared)
+  }
+  return self.shared
+}
+
+// Get a read-only copy of the text at a past version. Versions before
+// the ones that have been discarded can't be reconstructed.
+func (self *GapBuffer) VersionAt(version int) (*BufferVersion, error) {
+  if version < self.version_base {
+    return nil, BEFORE_START.Err()
+  } else if version > self.version {
+    return nil, PAST_END.Err()
+  } else if version == self.version {
+    return self.CurrentVersion(), nil
+  }
+  text := self.Bytes()
+  for i := self.version - 1; i >= version; i-- {
+    c := self.version_log[i-self.version_base]
+    rest := text[c.pos+len(c.inserted):]
+    text = append(append(text[:c.pos:c.pos], c.deleted...), rest...)
+  }
+  result := &BufferVersion{version, text, nil}
+  self.trackVersion(result)
+  return result, nil
+}
+
+// Map an offset in a past version of the text to the corresponding
+// offset in the current version. The gravity decides what happens to
+// an offset where text was inserted, just as it does for a mark.
+func (self *GapBuffer) MapOffset(pos int, version int, gravity Gravity) (int, error) {
+  if version < self.version_base {
+    return 0, BEFORE_START.Err()
+  } else if version > self.version {
+    return 0, PAST_END.Err()
+  }
+  for _, c := range self.version_log[version-self.version_base:] {
+    if n := len(c.deleted); pos >= c.pos+n {
+      pos -= n
+    } else if pos > c.pos {
+      pos = c.pos
+    }
+    if n := len(c.inserted); pos > c.pos || (pos == c.pos && gravity == RIGHT_GRAVITY) {
+      pos += n
+    }
+  }
+  return pos, nil
+}
+
+// Forget the changes that produced the versions before version, so
+// that the log doesn't grow forever. Those versions can't be
+// reconstructed afterwards.
+func (self *GapBuffer) DiscardVersionsBefore(version int) error {
+  if version > self.version {
+    return PAST_END.Err()
+  } else if version <= self.version_base {
+    return nil
+  }
+  self.version_log = append([]versionChange(nil), self.version_log[version-self.version_base:]...)
+  self.version_base = version
+  return nil
+}
+
+// Remember a BufferVersion that's been handed out, so that the log
+// isn't trimmed past it while it's in use.
+func (self *GapBuffer) trackVersion(v *BufferVersion) {
+  if len(self.versions) == cap(self.versions) {
+    self.versionsInUse()
+  }
+  self.versions = append(self.versions, weak.Make(v))
+}
+
+// Get the oldest version of any BufferVersion that's still in use,
+// forgetting the ones that aren't.
+func (self *GapBuffer) versionsInUse() (oldest int, ok bool) {
+  live := self.versions[:0]
+  for _, p := range self.versions {
+    if v := p.Value(); v != nil {
+      if !ok || v.version < oldest {
+        oldest, ok = v.version, true
+      }
+      live = append(live, p)
+    }
+  }
+  clear(self.versions[len(live):])
+  self.versions = live
+  return oldest, ok
+}
+
+// Discard the log before the versions that are still needed, after
+// the file has been read or written.
+func (self *GapBuffer) trimVersions() {
+  oldest := self.disk.version
+  if v, ok := self.versionsInUse(); ok && v < oldest {
+    oldest = v
+  }
+  self.DiscardVersionsBefore(oldest)
+}
+
+// Record a change to the text as a new version.
+func (self *GapBuffer) newVersion(pos int, deleted []uint8, inserted []uint8) {
+  if self.kind == RELOAD_CHANGE {
+    if _, ok := self.versionsInUse(); !ok {
+      // The log is about to be trimmed to the version that the file
+      // is read at, so there's no need to copy the file into it.
+      self.version++
+      self.version_base = self.version
+      self.version_log = nil
+      return
+    }
+  }
+  deleted = append([]uint8(nil), deleted...)
+  inserted = append([]uint8(nil), inserted...)
+  self.version_log = append(self.version_log, versionChange{pos, deleted, inserted})
+  self.version++
+}
+
+// Stop sharing the array with a BufferVersion, before writing to it.
+func (self *GapBuffer) unshare() {
+  if self.shared != nil {
+    data := make([]uint8, len(self.data))
+    copy(data, self.data)
+    self.data = data
+    self.shared = nil
+  }
+}